@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	startTime = time.Now()
+
+	totalRequests int64
+
+	activeRequestsMu sync.Mutex
+	activeRequests   = make(map[string]activeRequest)
+
+	adminServer *http.Server
+)
+
+type activeRequest struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+}
+
+type activeRequestsByStart []activeRequest
+
+func (l activeRequestsByStart) Len() int           { return len(l) }
+func (l activeRequestsByStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l activeRequestsByStart) Less(i, j int) bool { return l[i].StartedAt.Before(l[j].StartedAt) }
+
+// trackRequest registers the request as active. The returned function
+// should be called when the request is finished
+func trackRequest(reqID string, r *http.Request) func() {
+	atomic.AddInt64(&totalRequests, 1)
+
+	activeRequestsMu.Lock()
+	activeRequests[reqID] = activeRequest{
+		ID:        reqID,
+		Path:      sanitizeRequestURI(r),
+		StartedAt: time.Now(),
+	}
+	activeRequestsMu.Unlock()
+
+	return func() {
+		activeRequestsMu.Lock()
+		delete(activeRequests, reqID)
+		activeRequestsMu.Unlock()
+	}
+}
+
+func listActiveRequests() []activeRequest {
+	activeRequestsMu.Lock()
+	defer activeRequestsMu.Unlock()
+
+	list := make([]activeRequest, 0, len(activeRequests))
+	for _, req := range activeRequests {
+		req.Duration = time.Since(req.StartedAt).String()
+		list = append(list, req)
+	}
+
+	sort.Sort(activeRequestsByStart(list))
+
+	return list
+}
+
+var adminRedactedConfig = []string{"Keys", "Salts", "Secret", "ETagSignature", "IntegrityKey", "AdminSecret", "DownloadProxy"}
+
+func redactedConfig() map[string]interface{} {
+	var m map[string]interface{}
+
+	b, _ := json.Marshal(conf)
+	json.Unmarshal(b, &m)
+
+	for _, k := range adminRedactedConfig {
+		if _, ok := m[k]; ok {
+			m[k] = redactedValue
+		}
+	}
+
+	return m
+}
+
+func checkAdminSecret(s string) bool {
+	return strings.HasPrefix(s, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(s, "Bearer ")), []byte(conf.AdminSecret)) == 1
+}
+
+func respondWithJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func adminHandler(f func(rw http.ResponseWriter, r *http.Request), method string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !checkAdminSecret(r.Header.Get("Authorization")) {
+			respondWithJSON(rw, 403, map[string]string{"error": "Forbidden"})
+			return
+		}
+
+		if r.Method != method {
+			respondWithJSON(rw, 405, map[string]string{"error": "Method not allowed"})
+			return
+		}
+
+		log.Printf("[admin] %s: %s\n", r.Method, r.URL.Path)
+
+		f(rw, r)
+	}
+}
+
+func adminStats(rw http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	respondWithJSON(rw, 200, map[string]interface{}{
+		"uptime":          time.Since(startTime).String(),
+		"goroutines":      runtime.NumGoroutine(),
+		"total_requests":  atomic.LoadInt64(&totalRequests),
+		"active_requests": len(listActiveRequests()),
+		"memory": map[string]interface{}{
+			"alloc":         mem.Alloc,
+			"sys":           mem.Sys,
+			"heap_inuse":    mem.HeapInuse,
+			"gc_runs":       mem.NumGC,
+			"vips_mem":      vipsTrackedMem(),
+			"vips_mem_peak": vipsTrackedMemHighwater(),
+		},
+	})
+}
+
+func adminConfig(rw http.ResponseWriter, r *http.Request) {
+	respondWithJSON(rw, 200, redactedConfig())
+}
+
+func adminRequests(rw http.ResponseWriter, r *http.Request) {
+	respondWithJSON(rw, 200, listActiveRequests())
+}
+
+// cacheInfo extends the libvips operation cache stats with the result cache ones
+type cacheInfo struct {
+	vipsCacheInfo
+	Results resultCacheInfo `json:"results"`
+}
+
+func cacheStats() cacheInfo {
+	return cacheInfo{vipsCacheStats(), resultCacheStats()}
+}
+
+func adminCache(rw http.ResponseWriter, r *http.Request) {
+	respondWithJSON(rw, 200, cacheStats())
+}
+
+func adminCacheFlush(rw http.ResponseWriter, r *http.Request) {
+	vipsCacheDropAll()
+	flushResults()
+	respondWithJSON(rw, 200, cacheStats())
+}
+
+func adminLogLevel(rw http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("level")
+
+	l, ok := logLevels[name]
+	if !ok {
+		respondWithJSON(rw, 400, map[string]string{"error": "Invalid log level"})
+		return
+	}
+
+	setLogLevel(l)
+	log.Printf("[admin] Log level is set to %s\n", l)
+
+	respondWithJSON(rw, 200, map[string]string{"level": l.String()})
+}
+
+func startAdminServer() {
+	if len(conf.AdminBind) == 0 {
+		return
+	}
+
+	l, err := net.Listen("tcp", conf.AdminBind)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", adminHandler(adminStats, "GET"))
+	mux.HandleFunc("/config", adminHandler(adminConfig, "GET"))
+	mux.HandleFunc("/requests", adminHandler(adminRequests, "GET"))
+	mux.HandleFunc("/cache", adminHandler(adminCache, "GET"))
+	mux.HandleFunc("/cache/flush", adminHandler(adminCacheFlush, "POST"))
+	mux.HandleFunc("/log_level", adminHandler(adminLogLevel, "POST"))
+
+	adminServer = &http.Server{
+		Handler:        mux,
+		ReadTimeout:    time.Duration(conf.ReadTimeout) * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	go func() {
+		log.Printf("Starting admin server at %s\n", conf.AdminBind)
+		log.Fatal(adminServer.Serve(l))
+	}()
+}
+
+func shutdownAdminServer() {
+	if adminServer != nil {
+		shutdownServer(adminServer)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuit tracks the failure rate of an origin host during the current window
+type circuit struct {
+	state       circuitState
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+}
+
+var (
+	circuits      = make(map[string]*circuit)
+	circuitsMutex sync.Mutex
+)
+
+// circuitOpenError is returned when the origin isn't requested because its circuit is open
+type circuitOpenError struct {
+	host string
+}
+
+func (e circuitOpenError) Error() string {
+	return fmt.Sprintf("Origin %s is unavailable", e.host)
+}
+
+// The fallback image is served instead of the source image while the circuit is open
+var (
+	circuitFallbackImage     []byte
+	circuitFallbackImageType imageType
+)
+
+func isCircuitOpenError(err error) bool {
+	_, ok := err.(circuitOpenError)
+	return ok
+}
+
+func loadCircuitFallbackImage() ([]byte, error) {
+	if len(conf.CircuitBreakerFallbackImageData) > 0 {
+		data, err := base64.StdEncoding.DecodeString(conf.CircuitBreakerFallbackImageData)
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode fallback image data: %s", err)
+		}
+		return data, nil
+	}
+
+	data, err := ioutil.ReadFile(conf.CircuitBreakerFallbackImagePath)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read fallback image: %s", err)
+	}
+
+	return data, nil
+}
+
+func initCircuitBreaker() {
+	if len(conf.CircuitBreakerFallbackImagePath) == 0 && len(conf.CircuitBreakerFallbackImageData) == 0 {
+		return
+	}
+
+	data, err := loadCircuitFallbackImage()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	_, imgtypeStr, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		log.Fatalf("Can't decode fallback image: %s\n", err)
+	}
+
+	imgtype, ok := imageTypes[imgtypeStr]
+	if !ok || !vipsTypeSupportLoad[imgtype] {
+		log.Fatalln("Fallback image type is not supported")
+	}
+
+	circuitFallbackImage, circuitFallbackImageType = data, imgtype
+}
+
+func (c *circuit) reset(now time.Time) {
+	c.state = circuitClosed
+	c.windowStart = now
+	c.requests = 0
+	c.failures = 0
+}
+
+func (c *circuit) open(now time.Time) {
+	c.state = circuitOpen
+	c.openedAt = now
+}
+
+func getCircuit(host string) *circuit {
+	c, ok := circuits[host]
+	if !ok {
+		c = &circuit{windowStart: time.Now()}
+		circuits[host] = c
+	}
+	return c
+}
+
+// circuitAllows reports whether a request to the host can be performed.
+// When the open circuit times out, a single trial request is allowed
+func circuitAllows(host string) bool {
+	if !conf.CircuitBreaker {
+		return true
+	}
+
+	circuitsMutex.Lock()
+	defer circuitsMutex.Unlock()
+
+	c := getCircuit(host)
+
+	switch c.state {
+	case circuitOpen:
+		if time.Since(c.openedAt) < time.Duration(conf.CircuitBreakerTimeout)*time.Second {
+			return false
+		}
+		c.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		// The trial request is in progress
+		return false
+	}
+
+	return true
+}
+
+func reportCircuitResult(host string, success bool) {
+	if !conf.CircuitBreaker {
+		return
+	}
+
+	circuitsMutex.Lock()
+	defer circuitsMutex.Unlock()
+
+	c := getCircuit(host)
+	now := time.Now()
+
+	if c.state == circuitHalfOpen {
+		if success {
+			c.reset(now)
+		} else {
+			c.open(now)
+		}
+		return
+	}
+
+	if now.Sub(c.windowStart) > time.Duration(conf.CircuitBreakerWindow)*time.Second {
+		c.reset(now)
+	}
+
+	c.requests++
+	if !success {
+		c.failures++
+	}
+
+	if c.requests >= conf.CircuitBreakerMinRequests && float64(c.failures)/float64(c.requests) >= conf.CircuitBreakerThreshold {
+		c.open(now)
+		logWarning("Circuit for origin %s is open", host)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+func clientHint(r *http.Request, name string) string {
+	if v := r.Header.Get("Sec-CH-" + name); len(v) > 0 {
+		return v
+	}
+	return r.Header.Get(name)
+}
+
+// applyClientHints sets the DPR and the width from the client hints headers
+// if they aren't specified in the URL. The Width hint is in physical pixels
+func applyClientHints(po *processingOptions, r *http.Request) {
+	if po.Dpr == 1 {
+		if dpr, err := strconv.ParseFloat(clientHint(r, "DPR"), 64); err == nil && dpr > 0 && dpr <= maxDpr {
+			po.Dpr = dpr
+		}
+	}
+
+	if po.Width == 0 {
+		if width, err := strconv.Atoi(clientHint(r, "Width")); err == nil && width > 0 {
+			po.Width = int(float64(width)/po.Dpr + 0.5)
+		}
+	}
+}
+
+func setClientHintsHeaders(rw http.ResponseWriter, po processingOptions) {
+	rw.Header().Set("Accept-CH", "DPR, Width, Sec-CH-DPR, Sec-CH-Width")
+	rw.Header().Add("Vary", "DPR, Width, Sec-CH-DPR, Sec-CH-Width")
+	rw.Header().Set("Content-DPR", strconv.FormatFloat(po.Dpr, 'f', -1, 64))
+}
@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 )
 
 func intEnvConfig(i *int, name string) {
@@ -25,12 +27,50 @@ func megaIntEnvConfig(f *int, name string) {
 	}
 }
 
+func floatEnvConfig(f *float64, name string) {
+	if env, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil {
+		*f = env
+	}
+}
+
 func strEnvConfig(s *string, name string) {
 	if env := os.Getenv(name); len(env) > 0 {
 		*s = env
 	}
 }
 
+func strSliceEnvConfig(s *[]string, name string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		parts := strings.Split(env, ",")
+
+		for i, p := range parts {
+			parts[i] = strings.TrimSpace(p)
+		}
+
+		*s = parts
+	}
+}
+
+func intSliceEnvConfig(s *[]int, name string) {
+	var parts []string
+	strSliceEnvConfig(&parts, name)
+
+	if parts == nil {
+		return
+	}
+
+	ints := make([]int, len(parts))
+
+	for i, p := range parts {
+		var err error
+		if ints[i], err = strconv.Atoi(p); err != nil {
+			log.Fatalf("%s expected to be a comma-separated list of integers\n", name)
+		}
+	}
+
+	*s = ints
+}
+
 func boolEnvConfig(b *bool, name string) {
 	*b = false
 	if env, err := strconv.ParseBool(os.Getenv(name)); err == nil {
@@ -38,6 +78,16 @@ func boolEnvConfig(b *bool, name string) {
 	}
 }
 
+func colorEnvConfig(c *rgbColor, name string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		color, err := parseHexColor(env)
+		if err != nil {
+			log.Fatalf("%s expected to be a hex-encoded color\n", name)
+		}
+		*c = color
+	}
+}
+
 func hexEnvConfig(b *[]byte, name string) {
 	var err error
 
@@ -48,7 +98,25 @@ func hexEnvConfig(b *[]byte, name string) {
 	}
 }
 
-func hexFileConfig(b *[]byte, filepath string) {
+func hexSliceEnvConfig(b *[][]byte, name string) {
+	var parts []string
+	strSliceEnvConfig(&parts, name)
+
+	if parts == nil {
+		return
+	}
+
+	*b = make([][]byte, len(parts))
+
+	for i, p := range parts {
+		var err error
+		if (*b)[i], err = hex.DecodeString(p); err != nil {
+			log.Fatalf("%s expected to be a comma-separated list of hex-encoded strings\n", name)
+		}
+	}
+}
+
+func hexSliceFileConfig(b *[][]byte, filepath string) {
 	if len(filepath) == 0 {
 		return
 	}
@@ -63,59 +131,217 @@ func hexFileConfig(b *[]byte, filepath string) {
 		log.Fatalln(err)
 	}
 
-	src = bytes.TrimSpace(src)
+	var keys [][]byte
 
-	dst := make([]byte, hex.DecodedLen(len(src)))
-	n, err := hex.Decode(dst, src)
-	if err != nil {
-		log.Fatalf("%s expected to contain hex-encoded string\n", filepath)
+	// Each line of the file contains a hex-encoded string
+	for _, line := range bytes.Split(src, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		dst := make([]byte, hex.DecodedLen(len(line)))
+		n, err := hex.Decode(dst, line)
+		if err != nil {
+			log.Fatalf("%s expected to contain hex-encoded strings\n", filepath)
+		}
+
+		keys = append(keys, dst[:n])
 	}
 
-	*b = dst[:n]
+	*b = keys
 }
 
 type config struct {
 	Bind            string
+	GRPCBind        string
 	ReadTimeout     int
 	WaitTimeout     int
 	WriteTimeout    int
 	DownloadTimeout int
-	Concurrency     int
-	MaxClients      int
-	TTL             int
+
+	DownloadProxy string
+
+	DownloadRetries       int
+	DownloadRetryBackoff  int
+	DownloadRetryMaxDelay int
+	DownloadRetryStatuses []int
+	DownloadRetryErrors   []string
+	Concurrency           int
+	MaxClients            int
+	TTL                   int
+
+	CacheControlPassthrough bool
+	MinTTL                  int
+	MaxTTL                  int
+
+	ResultCacheSize     int
+	ResultCacheStaleTTL int
+
+	CacheControlPrivate              bool
+	CacheControlSMaxAge              int
+	CacheControlImmutable            bool
+	CacheControlStaleWhileRevalidate int
 
 	MaxSrcDimension  int
 	MaxSrcResolution int
 
-	Quality         int
-	GZipCompression int
-
-	Key  []byte
-	Salt []byte
+	MaxTimeoutOverride       int
+	MaxQualityOverride       int
+	MaxSrcDimensionOverride  int
+	MaxSrcResolutionOverride int
+
+	MaxResultWidth      int
+	MaxResultHeight     int
+	MaxResultResolution int
+
+	Quality               int
+	UseEmbeddedThumbnails bool
+	DisableAutoRotate     bool
+	Background            rgbColor
+	MetadataPolicy        metadataPolicy
+	KeepCopyright         bool
+	KeepIcc               bool
+	ResamplingKernel      resamplingKernel
+	SmartCropStrategy     smartCropStrategy
+	GZipCompression       int
+	UnsharpRadius         float64
+	UnsharpAmount         float64
+	UnsharpThreshold      float64
+	PNGPaletteColors      int
+	PNGDither             float64
+	JpegProgressive       bool
+	JpegNoSubsample       bool
+	PngInterlaced         bool
+	WebpLossless          bool
+	AvifQuality           int
+	AutoqualityMethod     autoqualityMethod
+	AutoqualityTarget     float64
+	AutoqualityMin        int
+	AutoqualityMax        int
+	AvifEffort            int
+	JxlEffort             int
+	EnableJxlDetection    bool
+	EnableWebpDetection   bool
+	EnableAvifDetection   bool
+	FormatPreference      []string
+	EnableClientHints     bool
+
+	Keys  [][]byte
+	Salts [][]byte
 
 	Secret string
 
 	LocalFileSystemRoot string
 
+	OriginMirrorsPath      string
+	OriginUnhealthyTimeout int
+
+	DNSCacheTTL     int
+	DNSResolver     string
+	DNSTimeout      int
+	DNSIPPreference string
+
+	CircuitBreaker            bool
+	CircuitBreakerThreshold   float64
+	CircuitBreakerMinRequests int
+	CircuitBreakerWindow      int
+	CircuitBreakerTimeout     int
+
+	CircuitBreakerFallbackImagePath string
+	CircuitBreakerFallbackImageData string
+
+	EnableVideoThumbnails bool
+	FFmpegPath            string
+
+	WatermarksPath   string
+	WatermarkPath    string
+	WatermarkData    string
+	WatermarkOpacity float64
+
+	WatermarkCacheSize int
+	WatermarkCacheTTL  int
+
+	TextFont string
+
+	PresetsPath string
+	OnlyPresets bool
+
+	VariantsPath     string
+	VariantKeyHeader string
+
+	ExifGPS bool
+
 	ETagEnabled   bool
 	ETagSignature []byte
+	ETagHash      string
+	ETagWeak      bool
+
+	LastModifiedEnabled bool
+
+	ReturnAttachment bool
+
+	IntegrityHeaders bool
+	IntegrityKey     []byte
+
+	JSONErrors bool
+
+	LogFullURLs bool
+	LogLevel    string
+
+	AdminBind   string
+	AdminSecret string
 }
 
 var conf = config{
-	Bind:             ":8080",
-	ReadTimeout:      10,
-	WriteTimeout:     10,
-	DownloadTimeout:  5,
-	Concurrency:      runtime.NumCPU() * 2,
-	TTL:              3600,
-	MaxSrcDimension:  8192,
-	MaxSrcResolution: 16800000,
-	Quality:          80,
-	GZipCompression:  5,
-	ETagEnabled:      false,
+	Bind:                      ":8080",
+	ReadTimeout:               10,
+	WriteTimeout:              10,
+	DownloadTimeout:           5,
+	DownloadRetryBackoff:      100,
+	DownloadRetryMaxDelay:     1000,
+	DownloadRetryStatuses:     []int{502, 503, 504},
+	DownloadRetryErrors:       []string{"timeout", "connection"},
+	Concurrency:               runtime.NumCPU() * 2,
+	TTL:                       3600,
+	MaxSrcDimension:           8192,
+	MaxSrcResolution:          16800000,
+	MaxResultWidth:            8192,
+	MaxResultHeight:           8192,
+	MaxResultResolution:       16800000,
+	Quality:                   80,
+	AutoqualityTarget:         0.02,
+	AutoqualityMin:            30,
+	AutoqualityMax:            90,
+	GZipCompression:           5,
+	Background:                rgbColor{255, 255, 255},
+	UnsharpAmount:             2,
+	UnsharpThreshold:          2,
+	OriginUnhealthyTimeout:    30,
+	FFmpegPath:                "ffmpeg",
+	WatermarkCacheSize:        100,
+	WatermarkCacheTTL:         3600,
+	TextFont:                  "sans",
+	DNSTimeout:                2,
+	CircuitBreakerThreshold:   0.5,
+	CircuitBreakerMinRequests: 20,
+	CircuitBreakerWindow:      10,
+	CircuitBreakerTimeout:     30,
+	PNGDither:                 1,
+	AvifEffort:                4,
+	JxlEffort:                 7,
+	FormatPreference:          []string{"jxl", "avif", "webp"},
+	ETagEnabled:               false,
+	ETagHash:                  "sha1",
+	LogLevel:                  "info",
 }
 
 func init() {
+	metadataPolicyName := "strip"
+	resamplingKernelName := "lanczos3"
+	smartCropStrategyName := "attention"
+	autoqualityMethodName := "none"
+
 	keypath := flag.String("keypath", "", "path of the file with hex-encoded key")
 	saltpath := flag.String("saltpath", "", "path of the file with hex-encoded salt")
 	flag.Parse()
@@ -125,38 +351,154 @@ func init() {
 	}
 
 	strEnvConfig(&conf.Bind, "IMGPROXY_BIND")
+	strEnvConfig(&conf.GRPCBind, "IMGPROXY_GRPC_BIND")
 	intEnvConfig(&conf.ReadTimeout, "IMGPROXY_READ_TIMEOUT")
 	intEnvConfig(&conf.WriteTimeout, "IMGPROXY_WRITE_TIMEOUT")
 	intEnvConfig(&conf.DownloadTimeout, "IMGPROXY_DOWNLOAD_TIMEOUT")
+	strEnvConfig(&conf.DownloadProxy, "IMGPROXY_DOWNLOAD_PROXY")
+	intEnvConfig(&conf.DownloadRetries, "IMGPROXY_DOWNLOAD_RETRIES")
+	intEnvConfig(&conf.DownloadRetryBackoff, "IMGPROXY_DOWNLOAD_RETRY_BACKOFF")
+	intEnvConfig(&conf.DownloadRetryMaxDelay, "IMGPROXY_DOWNLOAD_RETRY_MAX_DELAY")
+	intSliceEnvConfig(&conf.DownloadRetryStatuses, "IMGPROXY_DOWNLOAD_RETRY_STATUSES")
+	strSliceEnvConfig(&conf.DownloadRetryErrors, "IMGPROXY_DOWNLOAD_RETRY_ERRORS")
 	intEnvConfig(&conf.Concurrency, "IMGPROXY_CONCURRENCY")
 	intEnvConfig(&conf.MaxClients, "IMGPROXY_MAX_CLIENTS")
 
 	intEnvConfig(&conf.TTL, "IMGPROXY_TTL")
+	boolEnvConfig(&conf.CacheControlPassthrough, "IMGPROXY_CACHE_CONTROL_PASSTHROUGH")
+	intEnvConfig(&conf.MinTTL, "IMGPROXY_MIN_TTL")
+	intEnvConfig(&conf.MaxTTL, "IMGPROXY_MAX_TTL")
+
+	intEnvConfig(&conf.ResultCacheSize, "IMGPROXY_RESULT_CACHE_SIZE")
+	intEnvConfig(&conf.ResultCacheStaleTTL, "IMGPROXY_RESULT_CACHE_STALE_TTL")
+
+	boolEnvConfig(&conf.CacheControlPrivate, "IMGPROXY_CACHE_CONTROL_PRIVATE")
+	intEnvConfig(&conf.CacheControlSMaxAge, "IMGPROXY_CACHE_CONTROL_S_MAXAGE")
+	boolEnvConfig(&conf.CacheControlImmutable, "IMGPROXY_CACHE_CONTROL_IMMUTABLE")
+	intEnvConfig(&conf.CacheControlStaleWhileRevalidate, "IMGPROXY_CACHE_CONTROL_STALE_WHILE_REVALIDATE")
 
 	intEnvConfig(&conf.MaxSrcDimension, "IMGPROXY_MAX_SRC_DIMENSION")
 	megaIntEnvConfig(&conf.MaxSrcResolution, "IMGPROXY_MAX_SRC_RESOLUTION")
 
-	intEnvConfig(&conf.Quality, "IMGPROXY_QUALITY")
-	intEnvConfig(&conf.GZipCompression, "IMGPROXY_GZIP_COMPRESSION")
+	intEnvConfig(&conf.MaxTimeoutOverride, "IMGPROXY_MAX_TIMEOUT_OVERRIDE")
+	intEnvConfig(&conf.MaxQualityOverride, "IMGPROXY_MAX_QUALITY_OVERRIDE")
+	intEnvConfig(&conf.MaxSrcDimensionOverride, "IMGPROXY_MAX_SRC_DIMENSION_OVERRIDE")
+	megaIntEnvConfig(&conf.MaxSrcResolutionOverride, "IMGPROXY_MAX_SRC_RESOLUTION_OVERRIDE")
 
-	hexEnvConfig(&conf.Key, "IMGPROXY_KEY")
-	hexEnvConfig(&conf.Salt, "IMGPROXY_SALT")
+	intEnvConfig(&conf.MaxResultWidth, "IMGPROXY_MAX_RESULT_WIDTH")
+	intEnvConfig(&conf.MaxResultHeight, "IMGPROXY_MAX_RESULT_HEIGHT")
+	megaIntEnvConfig(&conf.MaxResultResolution, "IMGPROXY_MAX_RESULT_RESOLUTION")
 
-	hexFileConfig(&conf.Key, *keypath)
-	hexFileConfig(&conf.Salt, *saltpath)
+	intEnvConfig(&conf.Quality, "IMGPROXY_QUALITY")
+	boolEnvConfig(&conf.UseEmbeddedThumbnails, "IMGPROXY_USE_EMBEDDED_THUMBNAILS")
+	boolEnvConfig(&conf.DisableAutoRotate, "IMGPROXY_DISABLE_AUTO_ROTATE")
+	colorEnvConfig(&conf.Background, "IMGPROXY_BACKGROUND")
+	strEnvConfig(&metadataPolicyName, "IMGPROXY_METADATA_POLICY")
+	boolEnvConfig(&conf.KeepCopyright, "IMGPROXY_KEEP_COPYRIGHT")
+	boolEnvConfig(&conf.KeepIcc, "IMGPROXY_KEEP_ICC")
+	strEnvConfig(&resamplingKernelName, "IMGPROXY_RESAMPLING_KERNEL")
+	strEnvConfig(&smartCropStrategyName, "IMGPROXY_SMART_CROP_STRATEGY")
+	intEnvConfig(&conf.GZipCompression, "IMGPROXY_GZIP_COMPRESSION")
+	intEnvConfig(&conf.PNGPaletteColors, "IMGPROXY_PNG_PALETTE_COLORS")
+	floatEnvConfig(&conf.PNGDither, "IMGPROXY_PNG_DITHER")
+	floatEnvConfig(&conf.UnsharpRadius, "IMGPROXY_UNSHARP_RADIUS")
+	floatEnvConfig(&conf.UnsharpAmount, "IMGPROXY_UNSHARP_AMOUNT")
+	floatEnvConfig(&conf.UnsharpThreshold, "IMGPROXY_UNSHARP_THRESHOLD")
+	boolEnvConfig(&conf.JpegProgressive, "IMGPROXY_JPEG_PROGRESSIVE")
+	boolEnvConfig(&conf.JpegNoSubsample, "IMGPROXY_JPEG_NO_SUBSAMPLE")
+	boolEnvConfig(&conf.PngInterlaced, "IMGPROXY_PNG_INTERLACED")
+	boolEnvConfig(&conf.WebpLossless, "IMGPROXY_WEBP_LOSSLESS")
+	intEnvConfig(&conf.AvifQuality, "IMGPROXY_AVIF_QUALITY")
+	strEnvConfig(&autoqualityMethodName, "IMGPROXY_AUTOQUALITY_METHOD")
+	floatEnvConfig(&conf.AutoqualityTarget, "IMGPROXY_AUTOQUALITY_TARGET")
+	intEnvConfig(&conf.AutoqualityMin, "IMGPROXY_AUTOQUALITY_MIN")
+	intEnvConfig(&conf.AutoqualityMax, "IMGPROXY_AUTOQUALITY_MAX")
+	intEnvConfig(&conf.AvifEffort, "IMGPROXY_AVIF_EFFORT")
+	intEnvConfig(&conf.JxlEffort, "IMGPROXY_JXL_EFFORT")
+	boolEnvConfig(&conf.EnableJxlDetection, "IMGPROXY_ENABLE_JXL_DETECTION")
+	boolEnvConfig(&conf.EnableWebpDetection, "IMGPROXY_ENABLE_WEBP_DETECTION")
+	boolEnvConfig(&conf.EnableAvifDetection, "IMGPROXY_ENABLE_AVIF_DETECTION")
+	strSliceEnvConfig(&conf.FormatPreference, "IMGPROXY_FORMAT_PREFERENCE")
+	boolEnvConfig(&conf.EnableClientHints, "IMGPROXY_ENABLE_CLIENT_HINTS")
+
+	hexSliceEnvConfig(&conf.Keys, "IMGPROXY_KEY")
+	hexSliceEnvConfig(&conf.Salts, "IMGPROXY_SALT")
+
+	hexSliceFileConfig(&conf.Keys, *keypath)
+	hexSliceFileConfig(&conf.Salts, *saltpath)
 
 	strEnvConfig(&conf.Secret, "IMGPROXY_SECRET")
 
 	strEnvConfig(&conf.LocalFileSystemRoot, "IMGPROXY_LOCAL_FILESYSTEM_ROOT")
 
+	strEnvConfig(&conf.OriginMirrorsPath, "IMGPROXY_ORIGIN_MIRRORS_PATH")
+	intEnvConfig(&conf.OriginUnhealthyTimeout, "IMGPROXY_ORIGIN_UNHEALTHY_TIMEOUT")
+
+	intEnvConfig(&conf.DNSCacheTTL, "IMGPROXY_DNS_CACHE_TTL")
+	strEnvConfig(&conf.DNSResolver, "IMGPROXY_DNS_RESOLVER")
+	intEnvConfig(&conf.DNSTimeout, "IMGPROXY_DNS_TIMEOUT")
+	strEnvConfig(&conf.DNSIPPreference, "IMGPROXY_DNS_IP_PREFERENCE")
+
+	boolEnvConfig(&conf.CircuitBreaker, "IMGPROXY_CIRCUIT_BREAKER")
+	floatEnvConfig(&conf.CircuitBreakerThreshold, "IMGPROXY_CIRCUIT_BREAKER_THRESHOLD")
+	intEnvConfig(&conf.CircuitBreakerMinRequests, "IMGPROXY_CIRCUIT_BREAKER_MIN_REQUESTS")
+	intEnvConfig(&conf.CircuitBreakerWindow, "IMGPROXY_CIRCUIT_BREAKER_WINDOW")
+	intEnvConfig(&conf.CircuitBreakerTimeout, "IMGPROXY_CIRCUIT_BREAKER_TIMEOUT")
+	strEnvConfig(&conf.CircuitBreakerFallbackImagePath, "IMGPROXY_CIRCUIT_BREAKER_FALLBACK_IMAGE_PATH")
+	strEnvConfig(&conf.CircuitBreakerFallbackImageData, "IMGPROXY_CIRCUIT_BREAKER_FALLBACK_IMAGE_DATA")
+
+	boolEnvConfig(&conf.EnableVideoThumbnails, "IMGPROXY_ENABLE_VIDEO_THUMBNAILS")
+	strEnvConfig(&conf.FFmpegPath, "IMGPROXY_FFMPEG_PATH")
+
+	strEnvConfig(&conf.WatermarksPath, "IMGPROXY_WATERMARKS_PATH")
+	strEnvConfig(&conf.WatermarkPath, "IMGPROXY_WATERMARK_PATH")
+	strEnvConfig(&conf.WatermarkData, "IMGPROXY_WATERMARK_DATA")
+	floatEnvConfig(&conf.WatermarkOpacity, "IMGPROXY_WATERMARK_OPACITY")
+	intEnvConfig(&conf.WatermarkCacheSize, "IMGPROXY_WATERMARK_CACHE_SIZE")
+	intEnvConfig(&conf.WatermarkCacheTTL, "IMGPROXY_WATERMARK_CACHE_TTL")
+
+	strEnvConfig(&conf.TextFont, "IMGPROXY_TEXT_FONT")
+
+	strEnvConfig(&conf.PresetsPath, "IMGPROXY_PRESETS_PATH")
+	boolEnvConfig(&conf.OnlyPresets, "IMGPROXY_ONLY_PRESETS")
+
+	strEnvConfig(&conf.VariantsPath, "IMGPROXY_VARIANTS_PATH")
+	strEnvConfig(&conf.VariantKeyHeader, "IMGPROXY_VARIANT_KEY_HEADER")
+
+	boolEnvConfig(&conf.ExifGPS, "IMGPROXY_EXIF_GPS")
+
 	boolEnvConfig(&conf.ETagEnabled, "IMGPROXY_USE_ETAG")
+	strEnvConfig(&conf.ETagHash, "IMGPROXY_ETAG_HASH")
+	boolEnvConfig(&conf.ETagWeak, "IMGPROXY_ETAG_WEAK")
+	boolEnvConfig(&conf.LastModifiedEnabled, "IMGPROXY_USE_LAST_MODIFIED")
+
+	boolEnvConfig(&conf.ReturnAttachment, "IMGPROXY_RETURN_ATTACHMENT")
+
+	boolEnvConfig(&conf.IntegrityHeaders, "IMGPROXY_INTEGRITY_HEADERS")
+	hexEnvConfig(&conf.IntegrityKey, "IMGPROXY_INTEGRITY_KEY")
+
+	boolEnvConfig(&conf.JSONErrors, "IMGPROXY_JSON_ERRORS")
+
+	boolEnvConfig(&conf.LogFullURLs, "IMGPROXY_LOG_FULL_URLS")
+	strEnvConfig(&conf.LogLevel, "IMGPROXY_LOG_LEVEL")
+
+	strEnvConfig(&conf.AdminBind, "IMGPROXY_ADMIN_BIND")
+	strEnvConfig(&conf.AdminSecret, "IMGPROXY_ADMIN_SECRET")
 
-	if len(conf.Key) == 0 {
+	if len(conf.Keys) == 0 {
 		log.Fatalln("Key is not defined")
 	}
-	if len(conf.Salt) == 0 {
+	if len(conf.Salts) == 0 {
 		log.Fatalln("Salt is not defined")
 	}
+	if len(conf.Keys) != len(conf.Salts) {
+		log.Fatalf("Number of keys and number of salts should be equal. Keys: %d, salts: %d\n", len(conf.Keys), len(conf.Salts))
+	}
+	for i := range conf.Keys {
+		if len(conf.Keys[i]) == 0 || len(conf.Salts[i]) == 0 {
+			log.Fatalf("Key/salt pair #%d is empty\n", i)
+		}
+	}
 
 	if len(conf.Bind) == 0 {
 		log.Fatalln("Bind address is not defined")
@@ -174,6 +516,24 @@ func init() {
 		log.Fatalf("Download timeout should be greater than 0, now - %d\n", conf.DownloadTimeout)
 	}
 
+	if conf.DownloadRetries < 0 {
+		log.Fatalf("Download retries should be greater than or equal to 0, now - %d\n", conf.DownloadRetries)
+	}
+
+	if conf.DownloadRetryBackoff < 0 {
+		log.Fatalf("Download retry backoff should be greater than or equal to 0, now - %d\n", conf.DownloadRetryBackoff)
+	}
+
+	if conf.DownloadRetryMaxDelay <= 0 {
+		log.Fatalf("Download retry max delay should be greater than 0, now - %d\n", conf.DownloadRetryMaxDelay)
+	}
+
+	for _, class := range conf.DownloadRetryErrors {
+		if class != "timeout" && class != "connection" {
+			log.Fatalf("Unknown download retry error class: %s\n", class)
+		}
+	}
+
 	if conf.Concurrency <= 0 {
 		log.Fatalf("Concurrency should be greater than 0, now - %d\n", conf.Concurrency)
 	}
@@ -186,6 +546,34 @@ func init() {
 		log.Fatalf("TTL should be greater than 0, now - %d\n", conf.TTL)
 	}
 
+	if conf.MinTTL < 0 {
+		log.Fatalf("Min TTL should be greater than or equal to 0, now - %d\n", conf.MinTTL)
+	}
+
+	if conf.MaxTTL < 0 {
+		log.Fatalf("Max TTL should be greater than or equal to 0, now - %d\n", conf.MaxTTL)
+	} else if conf.MaxTTL > 0 && conf.MaxTTL < conf.MinTTL {
+		log.Fatalf("Max TTL can't be less than min TTL, now - %d\n", conf.MaxTTL)
+	}
+
+	if conf.ResultCacheSize < 0 {
+		log.Fatalf("Result cache size should be greater than or equal to 0, now - %d\n", conf.ResultCacheSize)
+	}
+
+	if conf.ResultCacheStaleTTL < 0 {
+		log.Fatalf("Result cache stale TTL should be greater than or equal to 0, now - %d\n", conf.ResultCacheStaleTTL)
+	}
+
+	if conf.CacheControlSMaxAge < 0 {
+		log.Fatalf("Cache-Control s-maxage should be greater than or equal to 0, now - %d\n", conf.CacheControlSMaxAge)
+	} else if conf.CacheControlSMaxAge > 0 && conf.CacheControlPrivate {
+		log.Fatalf("Cache-Control s-maxage can't be used with private responses\n")
+	}
+
+	if conf.CacheControlStaleWhileRevalidate < 0 {
+		log.Fatalf("Cache-Control stale-while-revalidate should be greater than or equal to 0, now - %d\n", conf.CacheControlStaleWhileRevalidate)
+	}
+
 	if conf.MaxSrcDimension <= 0 {
 		log.Fatalf("Max src dimension should be greater than 0, now - %d\n", conf.MaxSrcDimension)
 	}
@@ -194,12 +582,104 @@ func init() {
 		log.Fatalf("Max src resolution should be greater than 0, now - %d\n", conf.MaxSrcResolution)
 	}
 
+	if conf.MaxResultWidth <= 0 {
+		log.Fatalf("Max result width should be greater than 0, now - %d\n", conf.MaxResultWidth)
+	}
+
+	if conf.MaxResultHeight <= 0 {
+		log.Fatalf("Max result height should be greater than 0, now - %d\n", conf.MaxResultHeight)
+	}
+
+	if conf.MaxResultResolution <= 0 {
+		log.Fatalf("Max result resolution should be greater than 0, now - %d\n", conf.MaxResultResolution)
+	}
+
 	if conf.Quality <= 0 {
 		log.Fatalf("Quality should be greater than 0, now - %d\n", conf.Quality)
 	} else if conf.Quality > 100 {
 		log.Fatalf("Quality can't be greater than 100, now - %d\n", conf.Quality)
 	}
 
+	if conf.MaxQualityOverride > 100 {
+		log.Fatalf("Max quality override can't be greater than 100, now - %d\n", conf.MaxQualityOverride)
+	}
+
+	if conf.PNGPaletteColors != 0 && (conf.PNGPaletteColors < 2 || conf.PNGPaletteColors > 256) {
+		log.Fatalf("PNG palette colors should be between 2 and 256, now - %d\n", conf.PNGPaletteColors)
+	}
+
+	if conf.PNGDither < 0 || conf.PNGDither > 1 {
+		log.Fatalf("PNG dither should be between 0 and 1, now - %f\n", conf.PNGDither)
+	}
+
+	if conf.UnsharpRadius < 0 {
+		log.Fatalf("Unsharp radius should be greater than or equal to 0, now - %f\n", conf.UnsharpRadius)
+	}
+
+	if conf.UnsharpAmount < 0 {
+		log.Fatalf("Unsharp amount should be greater than or equal to 0, now - %f\n", conf.UnsharpAmount)
+	}
+
+	if conf.UnsharpThreshold < 0 {
+		log.Fatalf("Unsharp threshold should be greater than or equal to 0, now - %f\n", conf.UnsharpThreshold)
+	}
+
+	if conf.AvifQuality < 0 {
+		log.Fatalf("AVIF quality should be greater than or equal to 0, now - %d\n", conf.AvifQuality)
+	} else if conf.AvifQuality > 100 {
+		log.Fatalf("AVIF quality can't be greater than 100, now - %d\n", conf.AvifQuality)
+	}
+
+	if m, ok := autoqualityMethods[autoqualityMethodName]; ok {
+		conf.AutoqualityMethod = m
+	} else {
+		log.Fatalf("Unknown autoquality method: %s\n", autoqualityMethodName)
+	}
+
+	if conf.AutoqualityTarget <= 0 {
+		log.Fatalf("Autoquality target should be greater than 0, now - %f\n", conf.AutoqualityTarget)
+	}
+
+	if conf.AutoqualityMin <= 0 || conf.AutoqualityMin > 100 {
+		log.Fatalf("Autoquality min should be between 1 and 100, now - %d\n", conf.AutoqualityMin)
+	}
+
+	if conf.AutoqualityMax < conf.AutoqualityMin || conf.AutoqualityMax > 100 {
+		log.Fatalf("Autoquality max should be between %d and 100, now - %d\n", conf.AutoqualityMin, conf.AutoqualityMax)
+	}
+
+	if conf.AvifEffort < 0 || conf.AvifEffort > 9 {
+		log.Fatalf("AVIF effort should be between 0 and 9, now - %d\n", conf.AvifEffort)
+	}
+
+	if conf.JxlEffort < 1 || conf.JxlEffort > 9 {
+		log.Fatalf("JPEG XL effort should be between 1 and 9, now - %d\n", conf.JxlEffort)
+	}
+
+	for _, name := range conf.FormatPreference {
+		if name != "jxl" && name != "avif" && name != "webp" {
+			log.Fatalf("Format can't be negotiated: %s\n", name)
+		}
+	}
+
+	if p, ok := metadataPolicies[metadataPolicyName]; ok {
+		conf.MetadataPolicy = p
+	} else {
+		log.Fatalf("Unknown metadata policy: %s\n", metadataPolicyName)
+	}
+
+	if k, ok := resamplingKernels[resamplingKernelName]; ok {
+		conf.ResamplingKernel = k
+	} else {
+		log.Fatalf("Unknown resampling kernel: %s\n", resamplingKernelName)
+	}
+
+	if s, ok := smartCropStrategies[smartCropStrategyName]; ok {
+		conf.SmartCropStrategy = s
+	} else {
+		log.Fatalf("Unknown smart crop strategy: %s\n", smartCropStrategyName)
+	}
+
 	if conf.GZipCompression < 0 {
 		log.Fatalf("GZip compression should be greater than or quual to 0, now - %d\n", conf.GZipCompression)
 	} else if conf.GZipCompression > 9 {
@@ -220,6 +700,56 @@ func init() {
 		}
 	}
 
+	if conf.OriginUnhealthyTimeout < 0 {
+		log.Fatalf("Origin unhealthy timeout should be greater than or equal to 0, now - %d\n", conf.OriginUnhealthyTimeout)
+	}
+
+	if conf.DNSCacheTTL < 0 {
+		log.Fatalf("DNS cache TTL should be greater than or equal to 0, now - %d\n", conf.DNSCacheTTL)
+	}
+
+	if conf.DNSTimeout <= 0 {
+		log.Fatalf("DNS timeout should be greater than 0, now - %d\n", conf.DNSTimeout)
+	}
+
+	if len(conf.DNSResolver) > 0 {
+		if _, _, err := net.SplitHostPort(conf.DNSResolver); err != nil {
+			conf.DNSResolver = net.JoinHostPort(conf.DNSResolver, "53")
+		}
+	}
+
+	if len(conf.DNSIPPreference) > 0 && conf.DNSIPPreference != "ipv4" && conf.DNSIPPreference != "ipv6" {
+		log.Fatalf("Unknown DNS IP preference: %s\n", conf.DNSIPPreference)
+	}
+
+	if conf.CircuitBreakerThreshold <= 0 || conf.CircuitBreakerThreshold > 1 {
+		log.Fatalf("Circuit breaker threshold should be greater than 0 and less than or equal to 1, now - %f\n", conf.CircuitBreakerThreshold)
+	}
+
+	if conf.CircuitBreakerMinRequests <= 0 {
+		log.Fatalf("Circuit breaker min requests should be greater than 0, now - %d\n", conf.CircuitBreakerMinRequests)
+	}
+
+	if conf.CircuitBreakerWindow <= 0 {
+		log.Fatalf("Circuit breaker window should be greater than 0, now - %d\n", conf.CircuitBreakerWindow)
+	}
+
+	if conf.CircuitBreakerTimeout <= 0 {
+		log.Fatalf("Circuit breaker timeout should be greater than 0, now - %d\n", conf.CircuitBreakerTimeout)
+	}
+
+	if conf.WatermarkCacheSize < 0 {
+		log.Fatalf("Watermark cache size should be greater than or equal to 0, now - %d\n", conf.WatermarkCacheSize)
+	}
+
+	if conf.WatermarkCacheTTL <= 0 {
+		log.Fatalf("Watermark cache TTL should be greater than 0, now - %d\n", conf.WatermarkCacheTTL)
+	}
+
+	if _, ok := eTagHashes[conf.ETagHash]; !ok {
+		log.Fatalf("Unknown ETag hash: %s\n", conf.ETagHash)
+	}
+
 	if conf.ETagEnabled {
 		conf.ETagSignature = make([]byte, 16)
 		rand.Read(conf.ETagSignature)
@@ -227,6 +757,26 @@ func init() {
 			fmt.Sprintf("%x", conf.ETagSignature))
 	}
 
+	if l, ok := logLevels[conf.LogLevel]; ok {
+		setLogLevel(l)
+	} else {
+		log.Fatalf("Unknown log level: %s\n", conf.LogLevel)
+	}
+
+	if len(conf.AdminBind) > 0 && len(conf.AdminSecret) == 0 {
+		log.Fatalln("Admin secret is not defined")
+	}
+
+	if conf.LogFullURLs {
+		log.Println("Full URLs logging is enabled. Signatures and source URL credentials will appear in logs, don't use it in production")
+	}
+
 	initVips()
+	initVideo()
 	initDownloading()
+	initOrigins()
+	initWatermarks()
+	initCircuitBreaker()
+	initPresets()
+	initVariants()
 }
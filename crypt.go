@@ -13,14 +13,19 @@ func validatePath(token, path string) error {
 		return errors.New("Invalid token encoding")
 	}
 
-	mac := hmac.New(sha256.New, conf.Key)
-	mac.Write(conf.Salt)
-	mac.Write([]byte(path))
-	expectedMAC := mac.Sum(nil)
-
-	if !hmac.Equal(messageMAC, expectedMAC) {
-		return errors.New("Invalid token")
+	// Multiple key/salt pairs allow rotating keys without invalidating signed URLs
+	for i := range conf.Keys {
+		if hmac.Equal(messageMAC, signatureFor(path, conf.Keys[i], conf.Salts[i])) {
+			return nil
+		}
 	}
 
-	return nil
+	return errors.New("Invalid token")
+}
+
+func signatureFor(path string, key, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// dnsLookup is the lookup in progress. Concurrent lookups of the same host wait for it
+// instead of querying the DNS server again
+type dnsLookup struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+var (
+	dnsCache      = make(map[string]dnsCacheEntry)
+	dnsLookups    = make(map[string]*dnsLookup)
+	dnsCacheMutex sync.RWMutex
+)
+
+func dnsLookupEnabled() bool {
+	return conf.DNSCacheTTL > 0 || len(conf.DNSResolver) > 0 || len(conf.DNSIPPreference) > 0
+}
+
+// exchangeDNS sends the query to the DNS server and reads the response.
+// TCP messages are prefixed with their length
+func exchangeDNS(network string, query []byte) ([]byte, error) {
+	timeout := time.Duration(conf.DNSTimeout) * time.Second
+
+	conn, err := net.DialTimeout(network, conf.DNSResolver, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if network == "udp" {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var l uint16
+	if err = binary.Read(conn, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, l)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func queryDNS(name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+	// Unpredictable IDs make spoofing the responses harder
+	var id uint16
+	if err := binary.Read(rand.Reader, binary.BigEndian, &id); err != nil {
+		return nil, 0, err
+	}
+
+	question := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+
+	b, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var resp dnsmessage.Message
+
+	// The response doesn't fit into the UDP packet, so it's requested again over TCP
+	for _, network := range []string{"udp", "tcp"} {
+		respb, err := exchangeDNS(network, b)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if err = resp.Unpack(respb); err != nil {
+			return nil, 0, err
+		}
+
+		if !resp.Truncated {
+			break
+		}
+	}
+
+	if resp.Truncated {
+		return nil, 0, errors.New("DNS response is truncated")
+	}
+
+	if resp.ID != id || !resp.Response {
+		return nil, 0, errors.New("DNS response ID mismatch")
+	}
+
+	if len(resp.Questions) != 1 || resp.Questions[0].Type != question.Type ||
+		resp.Questions[0].Class != question.Class ||
+		!strings.EqualFold(resp.Questions[0].Name.String(), question.Name.String()) {
+		return nil, 0, errors.New("DNS response question mismatch")
+	}
+
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("DNS query failed with code %d", resp.RCode)
+	}
+
+	var (
+		ips []net.IP
+		ttl uint32
+	)
+
+	for _, a := range resp.Answers {
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+
+		if ttl == 0 || a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+	}
+
+	return ips, ttl, nil
+}
+
+// resolveWithServer queries the configured DNS server for both A and AAAA records.
+// It returns the minimal TTL of the records
+func resolveWithServer(host string) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ips4, ttl4, err4 := queryDNS(name, dnsmessage.TypeA)
+	ips6, ttl6, err6 := queryDNS(name, dnsmessage.TypeAAAA)
+
+	if err4 != nil && err6 != nil {
+		return nil, 0, err4
+	}
+
+	ttl := ttl4
+	if len(ips4) == 0 || (len(ips6) > 0 && ttl6 < ttl) {
+		ttl = ttl6
+	}
+
+	return append(ips4, ips6...), time.Duration(ttl) * time.Second, nil
+}
+
+// sortIPsByPreference moves the addresses of the preferred family to the front
+func sortIPsByPreference(ips []net.IP) []net.IP {
+	if len(conf.DNSIPPreference) == 0 {
+		return ips
+	}
+
+	preferred := make([]net.IP, 0, len(ips))
+	other := make([]net.IP, 0, len(ips))
+
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (conf.DNSIPPreference == "ipv4") {
+			preferred = append(preferred, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+
+	return append(preferred, other...)
+}
+
+func lookupHost(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	dnsCacheMutex.RLock()
+	entry, ok := dnsCache[host]
+	dnsCacheMutex.RUnlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	dnsCacheMutex.Lock()
+	if l, ok := dnsLookups[host]; ok {
+		dnsCacheMutex.Unlock()
+		<-l.done
+		return l.ips, l.err
+	}
+	l := &dnsLookup{done: make(chan struct{})}
+	dnsLookups[host] = l
+	dnsCacheMutex.Unlock()
+
+	l.ips, l.err = resolveHost(host)
+
+	dnsCacheMutex.Lock()
+	delete(dnsLookups, host)
+	dnsCacheMutex.Unlock()
+	close(l.done)
+
+	return l.ips, l.err
+}
+
+// resolveHost resolves the host and caches the addresses
+func resolveHost(host string) ([]net.IP, error) {
+	var (
+		ips []net.IP
+		ttl time.Duration
+		err error
+	)
+
+	maxTTL := time.Duration(conf.DNSCacheTTL) * time.Second
+
+	if len(conf.DNSResolver) > 0 {
+		ips, ttl, err = resolveWithServer(host)
+		if ttl > maxTTL {
+			ttl = maxTTL
+		}
+	} else {
+		ips, err = net.LookupIP(host)
+		ttl = maxTTL
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No addresses found for %s", host)
+	}
+
+	ips = sortIPsByPreference(ips)
+
+	if ttl > 0 {
+		dnsCacheMutex.Lock()
+		dnsCache[host] = dnsCacheEntry{ips: ips, expires: time.Now().Add(ttl)}
+		dnsCacheMutex.Unlock()
+	}
+
+	return ips, nil
+}
+
+// dnsDial resolves the host with lookupHost and dials the addresses one by one
+func dnsDial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := lookupHost(host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	dialer := net.Dialer{
+		Timeout:   time.Duration(conf.DownloadTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	var lastErr error
+
+	for _, ip := range ips {
+		if (network == "tcp4" && ip.To4() == nil) || (network == "tcp6" && ip.To4() != nil) {
+			continue
+		}
+
+		conn, err := dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("No suitable addresses found for %s", host)}
+	}
+
+	return nil, lastErr
+}
@@ -8,16 +8,88 @@ import (
 	"image"
 	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 
+	"golang.org/x/net/proxy"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
 	_ "golang.org/x/image/webp"
 )
 
+func init() {
+	// PDF dimensions are unknown until the page is rendered, so they are checked after loading
+	image.RegisterFormat("pdf", "%PDF", decodeUnsupported, decodeUnknownConfig)
+
+	image.RegisterFormat("ico", "\x00\x00\x01\x00", decodeUnsupported, decodeICOConfig)
+
+	// SVG dimensions depend on the DPI, so they are checked after loading
+	image.RegisterFormat("svg", "<svg", decodeUnsupported, decodeUnknownConfig)
+	image.RegisterFormat("svg", "<?xml", decodeUnsupported, decodeUnknownConfig)
+
+	// HEIF and AVIF are ISO BMFF containers, they are detected by the major brand of the ftyp box.
+	// Reading dimensions requires walking the boxes tree, so they are checked after loading too
+	for _, brand := range []string{"avif", "avis"} {
+		image.RegisterFormat("avif", "????ftyp"+brand, decodeUnsupported, decodeUnknownConfig)
+	}
+	for _, brand := range []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"} {
+		image.RegisterFormat("heic", "????ftyp"+brand, decodeUnsupported, decodeUnknownConfig)
+	}
+}
+
+func decodeUnsupported(r io.Reader) (image.Image, error) {
+	return nil, errors.New("Decoding is not supported")
+}
+
+func decodeUnknownConfig(r io.Reader) (image.Config, error) {
+	return image.Config{}, nil
+}
+
+// decodeICOConfig returns the dimensions of the biggest image of the icon
+func decodeICOConfig(r io.Reader) (image.Config, error) {
+	var header [6]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return image.Config{}, err
+	}
+
+	count := int(header[4]) | int(header[5])<<8
+	if count == 0 {
+		return image.Config{}, errors.New("Icon doesn't contain images")
+	}
+
+	imgconf := image.Config{}
+
+	entry := make([]byte, 16)
+	for i := 0; i < count; i++ {
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return image.Config{}, err
+		}
+
+		// 0 means 256
+		width, height := int(entry[0]), int(entry[1])
+		if width == 0 {
+			width = 256
+		}
+		if height == 0 {
+			height = 256
+		}
+
+		if width*height > imgconf.Width*imgconf.Height {
+			imgconf.Width, imgconf.Height = width, height
+		}
+	}
+
+	return imgconf, nil
+}
+
 var downloadClient *http.Client
 
 type netReader struct {
@@ -59,6 +131,12 @@ func initDownloading() {
 	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 	}
+	if dnsLookupEnabled() {
+		transport.Dial = dnsDial
+	}
+	if len(conf.DownloadProxy) > 0 {
+		setDownloadProxy(transport)
+	}
 	if conf.LocalFileSystemRoot != "" {
 		transport.RegisterProtocol("local", http.NewFileTransport(http.Dir(conf.LocalFileSystemRoot)))
 	}
@@ -68,17 +146,130 @@ func initDownloading() {
 	}
 }
 
-func checkTypeAndDimensions(r io.Reader) (imageType, error) {
+func isRetryableStatus(status int) bool {
+	for _, s := range conf.DownloadRetryStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func downloadErrorClass(err error) string {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return "timeout"
+	}
+
+	if _, ok := err.(*net.OpError); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "connection"
+	}
+
+	return "other"
+}
+
+func isRetryableError(err error) bool {
+	class := downloadErrorClass(err)
+
+	for _, c := range conf.DownloadRetryErrors {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// getWithRetries performs the GET request retrying it with an exponential backoff
+// when it fails with a retryable error or status. The request isn't retried
+// if the deadline would be exceeded while waiting
+func getWithRetries(imageURL string, header http.Header, deadline time.Time) (*http.Response, error) {
+	backoff := time.Duration(conf.DownloadRetryBackoff) * time.Millisecond
+	maxBackoff := time.Duration(conf.DownloadRetryMaxDelay) * time.Millisecond
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", imageURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		res, err := downloadClient.Do(req)
+
+		if attempt >= conf.DownloadRetries || time.Now().Add(backoff).After(deadline) {
+			return res, err
+		}
+
+		if err != nil {
+			if !isRetryableError(err) {
+				return res, err
+			}
+		} else {
+			if !isRetryableStatus(res.StatusCode) {
+				return res, err
+			}
+			res.Body.Close()
+		}
+
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+type dialerFunc func(network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(network, addr)
+}
+
+// setDownloadProxy makes the transport use the configured proxy instead of
+// the one defined by the environment
+func setDownloadProxy(transport *http.Transport) {
+	u, err := url.Parse(conf.DownloadProxy)
+	if err != nil {
+		log.Fatalf("Can't parse download proxy URL: %s\n", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		transport.Proxy = http.ProxyURL(u)
+	case "socks5":
+		var forward proxy.Dialer = proxy.Direct
+		if transport.Dial != nil {
+			forward = dialerFunc(transport.Dial)
+		}
+
+		dialer, err := proxy.FromURL(u, forward)
+		if err != nil {
+			log.Fatalf("Can't create download proxy dialer: %s\n", err)
+		}
+
+		transport.Proxy = nil
+		transport.Dial = dialer.Dial
+	default:
+		log.Fatalf("Unsupported download proxy scheme: %s\n", u.Scheme)
+	}
+}
+
+func checkTypeAndDimensions(r io.Reader, po processingOptions) (imageType, error) {
 	imgconf, imgtypeStr, err := image.DecodeConfig(r)
 	imgtype, imgtypeOk := imageTypes[imgtypeStr]
 
 	if err != nil {
 		return UNKNOWN, err
 	}
-	if imgconf.Width > conf.MaxSrcDimension || imgconf.Height > conf.MaxSrcDimension {
+	if imgconf.Width > po.MaxSrcDimension || imgconf.Height > po.MaxSrcDimension {
 		return UNKNOWN, errors.New("Source image is too big")
 	}
-	if imgconf.Width*imgconf.Height > conf.MaxSrcResolution {
+	if imgconf.Width*imgconf.Height > po.MaxSrcResolution {
 		return UNKNOWN, errors.New("Source image is too big")
 	}
 	if !imgtypeOk || !vipsTypeSupportLoad[imgtype] {
@@ -88,10 +279,10 @@ func checkTypeAndDimensions(r io.Reader) (imageType, error) {
 	return imgtype, nil
 }
 
-func readAndCheckImage(res *http.Response) ([]byte, imageType, error) {
+func readAndCheckImage(res *http.Response, po processingOptions) ([]byte, imageType, error) {
 	nr := newNetReader(res.Body)
 
-	imgtype, err := checkTypeAndDimensions(nr)
+	imgtype, err := checkTypeAndDimensions(nr, po)
 	if err != nil {
 		return nil, UNKNOWN, err
 	}
@@ -105,17 +296,25 @@ func readAndCheckImage(res *http.Response) ([]byte, imageType, error) {
 	return b, imgtype, err
 }
 
-func downloadImage(url string) ([]byte, imageType, error) {
-	res, err := downloadClient.Get(url)
+// downloadImage downloads the source image. The header is added to the request, so it can
+// be conditional. errSourceNotModified is returned if the origin responds with 304
+func downloadImage(url string, po processingOptions, header http.Header) ([]byte, imageType, http.Header, error) {
+	res, err := fetchImage(url, header, time.Now().Add(time.Duration(po.Timeout)*time.Second))
 	if err != nil {
-		return nil, UNKNOWN, err
+		return nil, UNKNOWN, nil, sanitizeError(err)
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == 304 {
+		return nil, UNKNOWN, res.Header, errSourceNotModified
+	}
+
 	if res.StatusCode != 200 {
 		body, _ := ioutil.ReadAll(res.Body)
-		return nil, UNKNOWN, fmt.Errorf("Can't download image; Status: %d; %s", res.StatusCode, string(body))
+		return nil, UNKNOWN, nil, fmt.Errorf("Can't download image; Status: %d; %s", res.StatusCode, string(body))
 	}
 
-	return readAndCheckImage(res)
+	b, imgtype, err := readAndCheckImage(res, po)
+
+	return b, imgtype, res.Header, err
 }
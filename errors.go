@@ -20,8 +20,9 @@ func newError(status int, msg string, pub string) imgproxyError {
 	return imgproxyError{status, msg, pub}
 }
 
-func newUnexpectedError(err error, skip int) imgproxyError {
-	msg := fmt.Sprintf("Unexpected error: %s\n%s", err, stacktrace(skip+1))
+// newUnexpectedError accepts any value passed to panic, not only errors
+func newUnexpectedError(err interface{}, skip int) imgproxyError {
+	msg := fmt.Sprintf("Unexpected error: %v\n%s", err, stacktrace(skip+1))
 	return imgproxyError{500, msg, "Internal error"}
 }
 
@@ -30,7 +31,7 @@ var (
 )
 
 func stacktrace(skip int) string {
-	callers := make([]uintptr, 10)
+	callers := make([]uintptr, 32)
 	n := runtime.Callers(skip+1, callers)
 
 	lines := make([]string, n)
@@ -2,19 +2,86 @@ package main
 
 import (
 	"crypto/sha1"
-	"encoding/binary"
+	"encoding/base64"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"net/http"
+	"strings"
 )
 
 var notModifiedErr = newError(304, "Not modified", "Not modified")
 
-func calcETag(b []byte, po *processingOptions) string {
-	footprint := sha1.Sum(b)
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 
+// eTagHashes are the algorithms of hashing the source image. CRC-32C is computed by the CPU
+// on most platforms, so it's much faster than SHA-1 while being good enough to detect changes
+var eTagHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"crc32c": func() hash.Hash { return crc32.New(crc32cTable) },
+}
+
+// ETags built from the origin validators have the "%options_hash/%kind%encoded_validator" form,
+// so the validator can be extracted from If-None-Match and sent to the origin
+const (
+	eTagOriginETag    = "E"
+	eTagOriginModTime = "M"
+)
+
+// optionsHash calculates the footprint of the processing options
+func optionsHash(po *processingOptions) string {
 	hash := sha1.New()
-	hash.Write(footprint[:])
-	binary.Write(hash, binary.LittleEndian, *po)
+	fmt.Fprintf(hash, "%+v", *po)
 	hash.Write(conf.ETagSignature)
 
 	return fmt.Sprintf("%x", hash.Sum(nil))
 }
+
+// calcETag builds the ETag from the origin ETag or Last-Modified header and the processing options hash.
+// If the origin doesn't provide validators, the hash of the source image is used
+func calcETag(b []byte, originHeader http.Header, optsHash string) string {
+	prefix := ""
+	if conf.ETagWeak {
+		prefix = "W/"
+	}
+
+	if etag := originHeader.Get("ETag"); len(etag) > 0 {
+		return fmt.Sprintf(`%s"%s/%s%s"`, prefix, optsHash, eTagOriginETag, base64.RawURLEncoding.EncodeToString([]byte(etag)))
+	}
+
+	if lm := originHeader.Get("Last-Modified"); len(lm) > 0 {
+		return fmt.Sprintf(`%s"%s/%s%s"`, prefix, optsHash, eTagOriginModTime, base64.RawURLEncoding.EncodeToString([]byte(lm)))
+	}
+
+	footprint := eTagHashes[conf.ETagHash]()
+	footprint.Write(b)
+
+	return fmt.Sprintf(`%s"%x/%s"`, prefix, footprint.Sum(nil), optsHash)
+}
+
+// originConditionalHeader extracts the origin validator from the If-None-Match header of the request
+// and builds the header of the conditional request to the origin.
+// It returns nil if the ETag wasn't built from the validators or the processing options differ
+func originConditionalHeader(r *http.Request, optsHash string) http.Header {
+	inm := strings.TrimPrefix(strings.TrimSpace(r.Header.Get("If-None-Match")), "W/")
+	inm = strings.Trim(inm, `"`)
+
+	parts := strings.SplitN(inm, "/", 2)
+	if len(parts) != 2 || len(parts[1]) < 2 || parts[0] != optsHash {
+		return nil
+	}
+
+	validator, err := base64.RawURLEncoding.DecodeString(parts[1][1:])
+	if err != nil {
+		return nil
+	}
+
+	switch parts[1][:1] {
+	case eTagOriginETag:
+		return http.Header{"If-None-Match": {string(validator)}}
+	case eTagOriginModTime:
+		return http.Header{"If-Modified-Since": {string(validator)}}
+	}
+
+	return nil
+}
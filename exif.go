@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	exifThumbnailOffsetTag = 0x0201
+	exifThumbnailLengthTag = 0x0202
+	exifIFDPointerTag      = 0x8769
+	exifGPSIFDPointerTag   = 0x8825
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+var exifIFD0Tags = map[uint16]string{
+	0x010E: "ImageDescription",
+	0x010F: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013B: "Artist",
+	0x8298: "Copyright",
+}
+
+var exifSubIFDTags = map[uint16]string{
+	0x829A: "ExposureTime",
+	0x829D: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9204: "ExposureBiasValue",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920A: "FocalLength",
+	0xA002: "PixelXDimension",
+	0xA003: "PixelYDimension",
+	0xA405: "FocalLengthIn35mmFilm",
+	0xA431: "BodySerialNumber",
+	0xA433: "LensMake",
+	0xA434: "LensModel",
+}
+
+var exifGPSTags = map[uint16]string{
+	0x0001: "GPSLatitudeRef",
+	0x0002: "GPSLatitude",
+	0x0003: "GPSLongitudeRef",
+	0x0004: "GPSLongitude",
+	0x0005: "GPSAltitudeRef",
+	0x0006: "GPSAltitude",
+	0x0007: "GPSTimeStamp",
+	0x001D: "GPSDateStamp",
+}
+
+// Sizes of the TIFF field types
+var tiffTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8,
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	Tag   uint16
+	Type  uint16
+	Count int
+	Value []byte
+}
+
+func newTIFFReader(data []byte) (*tiffReader, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+
+	switch string(data[:2]) {
+	case "II":
+		return &tiffReader{data, binary.LittleEndian}, true
+	case "MM":
+		return &tiffReader{data, binary.BigEndian}, true
+	}
+
+	return nil, false
+}
+
+func (t *tiffReader) firstIFD() int {
+	return int(t.order.Uint32(t.data[4:]))
+}
+
+// readIFD returns the entries of the IFD and the offset of the next one
+func (t *tiffReader) readIFD(offset int) ([]ifdEntry, int, bool) {
+	if offset <= 0 || offset+2 > len(t.data) {
+		return nil, 0, false
+	}
+
+	count := int(t.order.Uint16(t.data[offset:]))
+	end := offset + 2 + count*12
+	if end+4 > len(t.data) {
+		return nil, 0, false
+	}
+
+	entries := make([]ifdEntry, 0, count)
+
+	for i := 0; i < count; i++ {
+		raw := t.data[offset+2+i*12:]
+
+		e := ifdEntry{
+			Tag:   t.order.Uint16(raw),
+			Type:  t.order.Uint16(raw[2:]),
+			Count: int(t.order.Uint32(raw[4:])),
+		}
+
+		size, ok := tiffTypeSizes[e.Type]
+		if !ok || e.Count < 0 || e.Count > len(t.data) {
+			continue
+		}
+
+		if size*e.Count <= 4 {
+			e.Value = raw[8 : 8+size*e.Count]
+		} else if valueOffset := int(t.order.Uint32(raw[8:])); valueOffset+size*e.Count <= len(t.data) {
+			e.Value = t.data[valueOffset : valueOffset+size*e.Count]
+		} else {
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, int(t.order.Uint32(t.data[end:])), true
+}
+
+func (t *tiffReader) uintValue(e ifdEntry) int {
+	switch {
+	case e.Count < 1:
+		return 0
+	case e.Type == 3:
+		return int(t.order.Uint16(e.Value))
+	case e.Type == 4:
+		return int(t.order.Uint32(e.Value))
+	}
+	return 0
+}
+
+func (t *tiffReader) value(e ifdEntry) interface{} {
+	values := make([]interface{}, 0, e.Count)
+
+	switch e.Type {
+	case 2:
+		return strings.TrimSpace(strings.TrimRight(string(e.Value), "\x00"))
+	case 1, 6, 7:
+		if e.Count > 16 {
+			return fmt.Sprintf("%d bytes", e.Count)
+		}
+		for _, b := range e.Value {
+			values = append(values, int(b))
+		}
+	case 3, 8:
+		for i := 0; i < e.Count; i++ {
+			values = append(values, int(t.order.Uint16(e.Value[i*2:])))
+		}
+	case 4, 9:
+		for i := 0; i < e.Count; i++ {
+			values = append(values, int(t.order.Uint32(e.Value[i*4:])))
+		}
+	case 5, 10:
+		for i := 0; i < e.Count; i++ {
+			num, den := float64(t.order.Uint32(e.Value[i*8:])), float64(t.order.Uint32(e.Value[i*8+4:]))
+			if e.Type == 10 {
+				num, den = float64(int32(t.order.Uint32(e.Value[i*8:]))), float64(int32(t.order.Uint32(e.Value[i*8+4:])))
+			}
+			if den == 0 {
+				values = append(values, 0.0)
+			} else {
+				values = append(values, num/den)
+			}
+		}
+	}
+
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+func (t *tiffReader) readTags(offset int, tags map[uint16]string, fields map[string]interface{}) map[uint16]ifdEntry {
+	entries, _, ok := t.readIFD(offset)
+	if !ok {
+		return nil
+	}
+
+	byTag := make(map[uint16]ifdEntry, len(entries))
+
+	for _, e := range entries {
+		byTag[e.Tag] = e
+
+		if name, ok := tags[e.Tag]; ok {
+			fields[name] = t.value(e)
+		}
+	}
+
+	return byTag
+}
+
+func gpsCoordinate(v interface{}, ref interface{}) (float64, bool) {
+	parts, ok := v.([]interface{})
+	if !ok || len(parts) != 3 {
+		return 0, false
+	}
+
+	var coord float64
+	for i, p := range parts {
+		f, ok := p.(float64)
+		if !ok {
+			return 0, false
+		}
+		coord += f / math.Pow(60, float64(i))
+	}
+
+	if ref == "S" || ref == "W" {
+		coord = -coord
+	}
+
+	return coord, true
+}
+
+// parseExif returns the known EXIF fields. GPS fields are returned only if withGPS is true
+func parseExif(data []byte, withGPS bool) map[string]interface{} {
+	fields := make(map[string]interface{})
+
+	t, ok := newTIFFReader(data)
+	if !ok {
+		return fields
+	}
+
+	ifd0 := t.readTags(t.firstIFD(), exifIFD0Tags, fields)
+
+	if e, ok := ifd0[exifIFDPointerTag]; ok {
+		t.readTags(t.uintValue(e), exifSubIFDTags, fields)
+	}
+
+	if e, ok := ifd0[exifGPSIFDPointerTag]; ok && withGPS {
+		t.readTags(t.uintValue(e), exifGPSTags, fields)
+
+		if lat, ok := gpsCoordinate(fields["GPSLatitude"], fields["GPSLatitudeRef"]); ok {
+			fields["Latitude"] = lat
+		}
+		if lon, ok := gpsCoordinate(fields["GPSLongitude"], fields["GPSLongitudeRef"]); ok {
+			fields["Longitude"] = lon
+		}
+	}
+
+	return fields
+}
+
+// findJPEGSegment returns the first APPn segment of the JPEG which starts with the header
+func findJPEGSegment(data []byte, marker byte, header []byte) ([]byte, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, false
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return nil, false
+		}
+
+		// Start of scan, no more metadata segments
+		if data[pos+1] == 0xDA {
+			return nil, false
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, false
+		}
+
+		segment := data[pos+4 : pos+2+length]
+
+		if data[pos+1] == marker && bytes.HasPrefix(segment, header) {
+			return segment[len(header):], true
+		}
+
+		pos += 2 + length
+	}
+
+	return nil, false
+}
+
+// findPNGChunk returns the data of the first PNG chunk of the given type
+func findPNGChunk(data []byte, chunkType string, prefix []byte) ([]byte, bool) {
+	if len(data) < 8 || !bytes.Equal(data[:8], []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, false
+	}
+
+	for pos := 8; pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			return nil, false
+		}
+
+		typ := string(data[pos+4 : pos+8])
+		chunk := data[pos+8 : pos+8+length]
+
+		if typ == chunkType && bytes.HasPrefix(chunk, prefix) {
+			return chunk[len(prefix):], true
+		}
+
+		if typ == "IDAT" || typ == "IEND" {
+			return nil, false
+		}
+
+		pos += 12 + length
+	}
+
+	return nil, false
+}
+
+// findWebPChunk returns the data of the first RIFF chunk of the given type
+func findWebPChunk(data []byte, chunkType string) ([]byte, bool) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, false
+	}
+
+	for pos := 12; pos+8 <= len(data); {
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if length < 0 || pos+8+length > len(data) {
+			return nil, false
+		}
+
+		if string(data[pos:pos+4]) == chunkType {
+			return data[pos+8 : pos+8+length], true
+		}
+
+		pos += 8 + length + length%2
+	}
+
+	return nil, false
+}
+
+// findExif returns the TIFF structure of the image's EXIF data
+func findExif(data []byte, imgtype imageType) ([]byte, bool) {
+	switch imgtype {
+	case JPEG:
+		return findJPEGSegment(data, 0xE1, exifHeader)
+	case PNG:
+		return findPNGChunk(data, "eXIf", nil)
+	case WEBP:
+		if exif, ok := findWebPChunk(data, "EXIF"); ok {
+			return bytes.TrimPrefix(exif, exifHeader), true
+		}
+	}
+	return nil, false
+}
+
+// findXMP returns the image's XMP packet
+func findXMP(data []byte, imgtype imageType) ([]byte, bool) {
+	switch imgtype {
+	case JPEG:
+		return findJPEGSegment(data, 0xE1, xmpHeader)
+	case PNG:
+		// iTXt chunk: keyword, null separator, compression flag and method, empty language and translated keyword
+		return findPNGChunk(data, "iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"))
+	case WEBP:
+		return findWebPChunk(data, "XMP ")
+	}
+	return nil, false
+}
+
+// extractJPEGThumbnail returns the JPEG thumbnail embedded into the EXIF data
+func extractJPEGThumbnail(data []byte) ([]byte, bool) {
+	exif, ok := findExif(data, JPEG)
+	if !ok {
+		return nil, false
+	}
+
+	t, ok := newTIFFReader(exif)
+	if !ok {
+		return nil, false
+	}
+
+	// Skip IFD0 and read IFD1 which describes the thumbnail
+	_, next, ok := t.readIFD(t.firstIFD())
+	if !ok {
+		return nil, false
+	}
+
+	entries, _, ok := t.readIFD(next)
+	if !ok {
+		return nil, false
+	}
+
+	var offset, length int
+
+	for _, e := range entries {
+		switch e.Tag {
+		case exifThumbnailOffsetTag:
+			offset = t.uintValue(e)
+		case exifThumbnailLengthTag:
+			length = t.uintValue(e)
+		}
+	}
+
+	if offset <= 0 || length <= 0 || offset+length > len(exif) {
+		return nil, false
+	}
+
+	thumb := exif[offset : offset+length]
+	if len(thumb) < 2 || thumb[0] != 0xFF || thumb[1] != 0xD8 {
+		return nil, false
+	}
+
+	return thumb, true
+}
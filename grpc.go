@@ -0,0 +1,239 @@
+// +build grpc
+
+//go:generate protoc --go_out=plugins=grpc:. imgproxypb/imgproxy.proto
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/DarthSim/imgproxy/imgproxypb"
+	nanoid "github.com/matoous/go-nanoid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var grpcServer *grpc.Server
+
+type grpcHandler struct {
+	h *httpHandler
+}
+
+func startGRPCServer(h *httpHandler) {
+	if len(conf.GRPCBind) == 0 {
+		return
+	}
+
+	l, err := net.Listen("tcp", conf.GRPCBind)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	grpcServer = grpc.NewServer()
+	imgproxypb.RegisterImgproxyServer(grpcServer, &grpcHandler{h})
+
+	go func() {
+		log.Printf("Starting gRPC server at %s\n", conf.GRPCBind)
+		if err := grpcServer.Serve(l); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
+
+func shutdownGRPCServer() {
+	if grpcServer == nil {
+		return
+	}
+
+	log.Println("Shutting down the gRPC server...")
+	grpcServer.GracefulStop()
+}
+
+func grpcError(err imgproxyError) error {
+	var code codes.Code
+
+	switch {
+	case err.StatusCode == 403:
+		code = codes.PermissionDenied
+	case err.StatusCode == 404:
+		code = codes.NotFound
+	case err.StatusCode == 503:
+		code = codes.DeadlineExceeded
+	case err.StatusCode >= 400 && err.StatusCode < 500:
+		code = codes.InvalidArgument
+	default:
+		code = codes.Internal
+	}
+
+	return status.Error(code, err.PublicMessage)
+}
+
+func grpcAuthorization(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if auth := md["authorization"]; len(auth) > 0 {
+			return auth[0]
+		}
+	}
+	return ""
+}
+
+// serve runs f with the same authorization, concurrency limit and timeout
+// as HTTP requests have. Panics are converted to gRPC errors
+func (g *grpcHandler) serve(ctx context.Context, method string, f func(reqID string, t *timer)) (err error) {
+	reqID, _ := nanoid.Nanoid()
+
+	log.Printf("[%s] gRPC: %s\n", reqID, method)
+
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			ierr, ok := rerr.(imgproxyError)
+			if !ok {
+				ierr = newUnexpectedError(rerr, 4)
+			}
+
+			logResponse(ierr.StatusCode, fmt.Sprintf("[%s] %s", reqID, sanitizeMessage(ierr.Message)))
+			err = grpcError(ierr)
+		}
+	}()
+
+	if !checkSecret(grpcAuthorization(ctx)) {
+		panic(invalidSecretErr)
+	}
+
+	g.h.lock()
+	defer g.h.unlock()
+
+	// The client may want the response earlier than the write timeout
+	timeout := time.Duration(conf.WriteTimeout) * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := deadline.Sub(time.Now()); d < timeout {
+			timeout = d
+		}
+	}
+
+	f(reqID, startTimer(timeout, "Processing"))
+
+	return nil
+}
+
+func grpcDownloadImage(imgURL string, po processingOptions) ([]byte, imageType) {
+	if _, err := url.ParseRequestURI(imgURL); err != nil {
+		panic(newError(404, err.Error(), "Invalid image url"))
+	}
+
+	b, imgtype, _, err := downloadImage(imgURL, po, nil)
+	if err != nil {
+		panic(newError(404, err.Error(), "Image is unreachable"))
+	}
+
+	return b, imgtype
+}
+
+func grpcProcessingOptions(req *imgproxypb.ProcessRequest) (po processingOptions, err error) {
+	var ok bool
+
+	po = newProcessingOptions()
+
+	if len(req.Resize) > 0 {
+		if po.Resize, ok = resizeTypes[req.Resize]; !ok {
+			return po, fmt.Errorf("Invalid resize type: %s", req.Resize)
+		}
+	}
+
+	if req.Width < 0 {
+		return po, fmt.Errorf("Invalid width: %d", req.Width)
+	}
+	po.Width = int(req.Width)
+
+	if req.Height < 0 {
+		return po, fmt.Errorf("Invalid height: %d", req.Height)
+	}
+	po.Height = int(req.Height)
+
+	if len(req.Gravity) > 0 {
+		var g gravityType
+		if g, ok = gravityTypes[req.Gravity]; !ok {
+			return po, fmt.Errorf("Invalid gravity: %s", req.Gravity)
+		}
+		po.Gravity = gravityOptions{Type: g}
+	}
+
+	po.Enlarge = req.Enlarge
+
+	if len(req.Format) > 0 {
+		if po.Format, ok = imageTypes[req.Format]; !ok {
+			return po, fmt.Errorf("Invalid image format: %s", req.Format)
+		}
+		po.FormatSet = true
+	}
+
+	applyFormatQuality(&po)
+
+	return po, validateProcessingOptions(po)
+}
+
+func (g *grpcHandler) Process(ctx context.Context, req *imgproxypb.ProcessRequest) (res *imgproxypb.ProcessResponse, err error) {
+	err = g.serve(ctx, "Process", func(reqID string, t *timer) {
+		po, err := grpcProcessingOptions(req)
+		if err != nil {
+			panic(newError(400, err.Error(), err.Error()))
+		}
+
+		b, imgtype := grpcDownloadImage(req.Url, po)
+		resolveFormat(&po, imgtype)
+
+		t.Check()
+
+		b, err = processImage(b, imgtype, po, t)
+		if err != nil {
+			panic(newError(500, err.Error(), "Error occurred while processing image"))
+		}
+
+		t.Check()
+
+		res = &imgproxypb.ProcessResponse{Data: b, ContentType: mimes[po.Format]}
+
+		logResponse(200, fmt.Sprintf("[%s] Processed in %s: %s; %+v", reqID, t.Since(), sanitizeURL(req.Url), po))
+	})
+	return
+}
+
+func (g *grpcHandler) GetInfo(ctx context.Context, req *imgproxypb.InfoRequest) (res *imgproxypb.InfoResponse, err error) {
+	err = g.serve(ctx, "GetInfo", func(reqID string, t *timer) {
+		b, _ := grpcDownloadImage(req.Url, newProcessingOptions())
+
+		imgconf, format, err := image.DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			panic(newError(500, err.Error(), "Error occurred while reading image info"))
+		}
+
+		res = &imgproxypb.InfoResponse{
+			Format: format,
+			Width:  int32(imgconf.Width),
+			Height: int32(imgconf.Height),
+		}
+
+		logResponse(200, fmt.Sprintf("[%s] Info fetched in %s: %s", reqID, t.Since(), sanitizeURL(req.Url)))
+	})
+	return
+}
+
+func (g *grpcHandler) Prefetch(ctx context.Context, req *imgproxypb.PrefetchRequest) (res *imgproxypb.PrefetchResponse, err error) {
+	err = g.serve(ctx, "Prefetch", func(reqID string, t *timer) {
+		grpcDownloadImage(req.Url, newProcessingOptions())
+
+		res = &imgproxypb.PrefetchResponse{}
+
+		logResponse(200, fmt.Sprintf("[%s] Prefetched in %s: %s", reqID, t.Since(), sanitizeURL(req.Url)))
+	})
+	return
+}
@@ -0,0 +1,15 @@
+// +build !grpc
+
+package main
+
+import "log"
+
+func startGRPCServer(_ *httpHandler) {
+	if len(conf.GRPCBind) > 0 {
+		log.Fatalln("imgproxy is built without gRPC support. Rebuild it with the grpc build tag")
+	}
+}
+
+func shutdownGRPCServer() {
+	// Nothing to shut down
+}
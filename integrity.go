@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// setIntegrityHeaders sets the SHA-256 digest of the response body and,
+// if the integrity key is set, the HMAC signature of the response metadata
+func setIntegrityHeaders(rw http.ResponseWriter, r *http.Request, data []byte) {
+	sum := sha256.Sum256(data)
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+
+	rw.Header().Set("Digest", fmt.Sprintf("sha-256=%s", digest))
+	rw.Header().Set("Repr-Digest", fmt.Sprintf("sha-256=:%s:", digest))
+
+	if len(conf.IntegrityKey) == 0 {
+		return
+	}
+
+	mac := hmac.New(sha256.New, conf.IntegrityKey)
+	for _, v := range []string{
+		r.URL.RequestURI(),
+		rw.Header().Get("Content-Type"),
+		rw.Header().Get("Content-Encoding"),
+		strconv.Itoa(len(data)),
+		digest,
+	} {
+		mac.Write([]byte(v))
+		mac.Write([]byte("\n"))
+	}
+
+	rw.Header().Set("X-Imgproxy-Integrity", base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+var errSourceNotModified = errors.New("Source image is not modified")
+
+// ifModifiedSince returns the If-Modified-Since header of the request that should be sent
+// to the origin. RFC 7232 says it's ignored when If-None-Match is present
+func ifModifiedSince(r *http.Request) string {
+	if !conf.LastModifiedEnabled || (conf.ETagEnabled && len(r.Header.Get("If-None-Match")) > 0) {
+		return ""
+	}
+
+	return r.Header.Get("If-Modified-Since")
+}
+
+// notModifiedSince returns true if the source image wasn't modified since the time
+// requested by the client. It's needed when the origin ignores conditional requests
+func notModifiedSince(r *http.Request, originHeader http.Header) bool {
+	ims := ifModifiedSince(r)
+	if len(ims) == 0 {
+		return false
+	}
+
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(originHeader.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !modified.After(since)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+type logLevel int32
+
+const (
+	logLevelInfo logLevel = iota
+	logLevelWarn
+	logLevelError
+)
+
+var logLevels = map[string]logLevel{
+	"info":  logLevelInfo,
+	"warn":  logLevelWarn,
+	"error": logLevelError,
+}
+
+var currentLogLevel int32
+
+func setLogLevel(l logLevel) {
+	atomic.StoreInt32(&currentLogLevel, int32(l))
+}
+
+func getLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&currentLogLevel))
+}
+
+func logLevelEnabled(l logLevel) bool {
+	return l >= getLogLevel()
+}
+
+func logWarning(f string, args ...interface{}) {
+	if logLevelEnabled(logLevelWarn) {
+		log.Printf("[WARN] "+f+"\n", args...)
+	}
+}
+
+func (l logLevel) String() string {
+	for name, ll := range logLevels {
+		if ll == l {
+			return name
+		}
+	}
+	return "unknown"
+}
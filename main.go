@@ -25,8 +25,10 @@ func main() {
 		log.Fatal(err)
 	}
 
+	h := newHTTPHandler()
+
 	s := &http.Server{
-		Handler:        newHTTPHandler(),
+		Handler:        h,
 		ReadTimeout:    time.Duration(conf.ReadTimeout) * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
@@ -34,6 +36,9 @@ func main() {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, os.Kill)
 
+	startGRPCServer(h)
+	startAdminServer()
+
 	go func() {
 		log.Printf("Starting server at %s\n", conf.Bind)
 		log.Fatal(s.Serve(netutil.LimitListener(l, conf.MaxClients)))
@@ -41,6 +46,8 @@ func main() {
 
 	<-stop
 
+	shutdownGRPCServer()
 	shutdownVips()
 	shutdownServer(s)
+	shutdownAdminServer()
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// originMirrors maps origin hosts to the list of their mirrors
+var originMirrors = make(map[string][]string)
+
+var (
+	unhealthyOrigins      = make(map[string]time.Time)
+	unhealthyOriginsMutex sync.Mutex
+)
+
+func markOriginUnhealthy(host string) {
+	unhealthyOriginsMutex.Lock()
+	defer unhealthyOriginsMutex.Unlock()
+
+	unhealthyOrigins[host] = time.Now().Add(time.Duration(conf.OriginUnhealthyTimeout) * time.Second)
+}
+
+func markOriginHealthy(host string) {
+	unhealthyOriginsMutex.Lock()
+	defer unhealthyOriginsMutex.Unlock()
+
+	delete(unhealthyOrigins, host)
+}
+
+func isOriginHealthy(host string) bool {
+	unhealthyOriginsMutex.Lock()
+	defer unhealthyOriginsMutex.Unlock()
+
+	until, ok := unhealthyOrigins[host]
+	if ok && time.Now().After(until) {
+		delete(unhealthyOrigins, host)
+		return true
+	}
+
+	return !ok
+}
+
+// mirrorURL replaces the host of the URL with the mirror. Mirror can contain a scheme
+func mirrorURL(u *url.URL, mirror string) *url.URL {
+	mu := *u
+
+	if i := strings.Index(mirror, "://"); i >= 0 {
+		mu.Scheme = mirror[:i]
+		mirror = mirror[i+3:]
+	}
+
+	mu.Host = mirror
+
+	return &mu
+}
+
+// originCandidates returns the URL itself followed by the URLs of the mirrors.
+// Healthy origins go first, so unhealthy ones are tried only as a last resort
+func originCandidates(imageURL string) []*url.URL {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return nil
+	}
+
+	candidates := []*url.URL{u}
+	for _, mirror := range originMirrors[u.Host] {
+		candidates = append(candidates, mirrorURL(u, mirror))
+	}
+
+	healthy := make([]*url.URL, 0, len(candidates))
+	unhealthy := make([]*url.URL, 0, len(candidates))
+
+	for _, c := range candidates {
+		if isOriginHealthy(c.Host) {
+			healthy = append(healthy, c)
+		} else {
+			unhealthy = append(unhealthy, c)
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// fetchImage requests the image from the origin and falls back to its mirrors
+// when the origin fails or responds with 5xx
+func fetchImage(imageURL string, header http.Header, deadline time.Time) (*http.Response, error) {
+	candidates := originCandidates(imageURL)
+	if len(candidates) == 0 {
+		return getWithRetries(imageURL, header, deadline)
+	}
+
+	var (
+		res *http.Response
+		err error
+	)
+
+	for i, u := range candidates {
+		if !circuitAllows(u.Host) {
+			res, err = nil, circuitOpenError{u.Host}
+			continue
+		}
+
+		res, err = getWithRetries(u.String(), header, deadline)
+
+		failed := err != nil || res.StatusCode >= 500
+		reportCircuitResult(u.Host, !failed)
+
+		if !failed {
+			markOriginHealthy(u.Host)
+			return res, nil
+		}
+
+		if len(candidates) > 1 {
+			markOriginUnhealthy(u.Host)
+		}
+
+		if i < len(candidates)-1 {
+			if err == nil {
+				res.Body.Close()
+			}
+			logWarning("Origin %s failed, trying the next mirror", u.Host)
+		}
+	}
+
+	return res, err
+}
+
+func initOrigins() {
+	if len(conf.OriginMirrorsPath) == 0 {
+		return
+	}
+
+	src, err := ioutil.ReadFile(conf.OriginMirrorsPath)
+	if err != nil {
+		log.Fatalf("Can't read origin mirrors file: %s\n", err)
+	}
+
+	if err = yaml.Unmarshal(src, &originMirrors); err != nil {
+		log.Fatalf("Can't parse origin mirrors file: %s\n", err)
+	}
+}
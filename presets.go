@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var presets = make(map[string][]string)
+
+// parsePreset parses the preset definition like "name=option1:arg/option2:arg"
+func parsePreset(str string) error {
+	str = strings.TrimSpace(str)
+
+	if len(str) == 0 || strings.HasPrefix(str, "#") {
+		return nil
+	}
+
+	parts := strings.SplitN(str, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid preset string: %s", str)
+	}
+
+	name := strings.TrimSpace(parts[0])
+	if len(name) == 0 {
+		return fmt.Errorf("Empty preset name: %s", str)
+	}
+
+	value := strings.TrimSpace(parts[1])
+	if len(value) == 0 {
+		return fmt.Errorf("Empty preset value: %s", str)
+	}
+
+	options := strings.Split(value, "/")
+
+	for _, option := range options {
+		if !strings.Contains(option, ":") {
+			return fmt.Errorf("Invalid preset %s option: %s", name, option)
+		}
+		if name := strings.SplitN(option, ":", 2)[0]; name == "preset" || name == "pr" {
+			return fmt.Errorf("Preset %s can't contain another preset", parts[0])
+		}
+	}
+
+	presets[name] = options
+
+	return nil
+}
+
+func applyPreset(po *processingOptions, name string) error {
+	options, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("Unknown preset: %s", name)
+	}
+
+	for _, option := range options {
+		args := strings.Split(option, ":")
+		if err := applyProcessingOption(po, args[0], args[1:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func initPresets() {
+	var envPresets []string
+	strSliceEnvConfig(&envPresets, "IMGPROXY_PRESETS")
+
+	for _, p := range envPresets {
+		if err := parsePreset(p); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if len(conf.PresetsPath) > 0 {
+		f, err := os.Open(conf.PresetsPath)
+		if err != nil {
+			log.Fatalf("Can't open presets file: %s\n", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if err = parsePreset(scanner.Text()); err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		if err = scanner.Err(); err != nil {
+			log.Fatalf("Can't read presets file: %s\n", err)
+		}
+	}
+
+	if conf.OnlyPresets && len(presets) == 0 {
+		log.Fatalln("Presets-only mode is enabled, but no presets are defined")
+	}
+
+	// Check that presets produce valid options
+	for name := range presets {
+		po := newProcessingOptions()
+		if err := applyPreset(&po, name); err != nil {
+			log.Fatalf("Preset %s is invalid: %s\n", name, err)
+		}
+	}
+}
@@ -9,10 +9,12 @@ import "C"
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"math"
 	"os"
 	"runtime"
+	"time"
 	"unsafe"
 )
 
@@ -24,6 +26,15 @@ const (
 	PNG     = C.PNG
 	WEBP    = C.WEBP
 	GIF     = C.GIF
+	TIFF    = C.TIFF
+	PDF     = C.PDF
+	AVIF    = C.AVIF
+	HEIF    = C.HEIF
+	SVG     = C.SVG
+	VIDEO   = C.VIDEO
+	JXL     = C.JXL
+	BMP     = C.BMP
+	ICO     = C.ICO
 )
 
 var imageTypes = map[string]imageType{
@@ -32,6 +43,17 @@ var imageTypes = map[string]imageType{
 	"png":  PNG,
 	"webp": WEBP,
 	"gif":  GIF,
+	"tiff": TIFF,
+	"pdf":  PDF,
+	"avif": AVIF,
+	"heic": HEIF,
+	"heif": HEIF,
+	"svg":  SVG,
+	"mp4":  VIDEO,
+	"webm": VIDEO,
+	"jxl":  JXL,
+	"bmp":  BMP,
+	"ico":  ICO,
 }
 
 type gravityType int
@@ -43,15 +65,33 @@ const (
 	SOUTH
 	WEST
 	SMART
+	NORTH_EAST
+	NORTH_WEST
+	SOUTH_EAST
+	SOUTH_WEST
+	// FOCUS_POINT isn't listed in gravityTypes since it requires coordinates
+	FOCUS_POINT
 )
 
 var gravityTypes = map[string]gravityType{
-	"ce": CENTER,
-	"no": NORTH,
-	"ea": EAST,
-	"so": SOUTH,
-	"we": WEST,
-	"sm": SMART,
+	"ce":   CENTER,
+	"no":   NORTH,
+	"ea":   EAST,
+	"so":   SOUTH,
+	"we":   WEST,
+	"sm":   SMART,
+	"noea": NORTH_EAST,
+	"nowe": NORTH_WEST,
+	"soea": SOUTH_EAST,
+	"sowe": SOUTH_WEST,
+}
+
+// gravityOptions is the gravity with its arguments. X and Y are the relative
+// coordinates of the focus point for FOCUS_POINT gravity and the offsets in pixels
+// from the anchor for the rest
+type gravityOptions struct {
+	Type gravityType
+	X, Y float64
 }
 
 type resizeType int
@@ -60,21 +100,255 @@ const (
 	FIT resizeType = iota
 	FILL
 	CROP
+	LETTERBOX
+	FORCE
+	FILL_DOWN
+	AUTO
 )
 
 var resizeTypes = map[string]resizeType{
-	"fit":  FIT,
-	"fill": FILL,
-	"crop": CROP,
+	"fit":       FIT,
+	"fill":      FILL,
+	"crop":      CROP,
+	"letterbox": LETTERBOX,
+	"force":     FORCE,
+	"fill-down": FILL_DOWN,
+	"auto":      AUTO,
+}
+
+type resamplingKernel int
+
+const (
+	LANCZOS3 resamplingKernel = C.VIPS_KERNEL_LANCZOS3
+	LANCZOS2 resamplingKernel = C.VIPS_KERNEL_LANCZOS2
+	CUBIC    resamplingKernel = C.VIPS_KERNEL_CUBIC
+	LINEAR   resamplingKernel = C.VIPS_KERNEL_LINEAR
+	NEAREST  resamplingKernel = C.VIPS_KERNEL_NEAREST
+)
+
+var resamplingKernels = map[string]resamplingKernel{
+	"lanczos3": LANCZOS3,
+	"lanczos2": LANCZOS2,
+	"cubic":    CUBIC,
+	"linear":   LINEAR,
+	"nearest":  NEAREST,
+}
+
+type smartCropStrategy int
+
+const (
+	ATTENTION smartCropStrategy = C.VIPS_INTERESTING_ATTENTION
+	ENTROPY   smartCropStrategy = C.VIPS_INTERESTING_ENTROPY
+)
+
+var smartCropStrategies = map[string]smartCropStrategy{
+	"attention": ATTENTION,
+	"entropy":   ENTROPY,
+}
+
+type autoqualityMethod int
+
+const (
+	AUTOQUALITY_NONE autoqualityMethod = iota
+	AUTOQUALITY_DSSIM
+)
+
+var autoqualityMethods = map[string]autoqualityMethod{
+	"none":  AUTOQUALITY_NONE,
+	"dssim": AUTOQUALITY_DSSIM,
+}
+
+type blendMode int
+
+const (
+	BLEND_OVER       blendMode = C.VIPS_BLEND_MODE_OVER
+	BLEND_MULTIPLY   blendMode = C.VIPS_BLEND_MODE_MULTIPLY
+	BLEND_SCREEN     blendMode = C.VIPS_BLEND_MODE_SCREEN
+	BLEND_OVERLAY    blendMode = C.VIPS_BLEND_MODE_OVERLAY
+	BLEND_DARKEN     blendMode = C.VIPS_BLEND_MODE_DARKEN
+	BLEND_LIGHTEN    blendMode = C.VIPS_BLEND_MODE_LIGHTEN
+	BLEND_HARD_LIGHT blendMode = C.VIPS_BLEND_MODE_HARD_LIGHT
+	BLEND_SOFT_LIGHT blendMode = C.VIPS_BLEND_MODE_SOFT_LIGHT
+	BLEND_DIFFERENCE blendMode = C.VIPS_BLEND_MODE_DIFFERENCE
+	BLEND_EXCLUSION  blendMode = C.VIPS_BLEND_MODE_EXCLUSION
+)
+
+var blendModes = map[string]blendMode{
+	"over":       BLEND_OVER,
+	"multiply":   BLEND_MULTIPLY,
+	"screen":     BLEND_SCREEN,
+	"overlay":    BLEND_OVERLAY,
+	"darken":     BLEND_DARKEN,
+	"lighten":    BLEND_LIGHTEN,
+	"hard_light": BLEND_HARD_LIGHT,
+	"soft_light": BLEND_SOFT_LIGHT,
+	"difference": BLEND_DIFFERENCE,
+	"exclusion":  BLEND_EXCLUSION,
+}
+
+type equalizeType int
+
+const (
+	EQUALIZE_NONE equalizeType = iota
+	EQUALIZE_GLOBAL
+	EQUALIZE_LOCAL
+)
+
+var equalizeTypes = map[string]equalizeType{
+	"none":   EQUALIZE_NONE,
+	"global": EQUALIZE_GLOBAL,
+	"local":  EQUALIZE_LOCAL,
+}
+
+type metadataPolicy int
+
+const (
+	METADATA_STRIP metadataPolicy = iota
+	METADATA_KEEP
+	METADATA_PRIVACY
+)
+
+var metadataPolicies = map[string]metadataPolicy{
+	"strip":   METADATA_STRIP,
+	"keep":    METADATA_KEEP,
+	"privacy": METADATA_PRIVACY,
 }
 
 type processingOptions struct {
-	Resize  resizeType
-	Width   int
-	Height  int
-	Gravity gravityType
-	Enlarge bool
-	Format  imageType
+	Resize resizeType
+	Width  int
+	Height int
+	// MinWidth and MinHeight are the minimal size of the image resized with FIT
+	MinWidth  int
+	MinHeight int
+	Gravity   gravityOptions
+	Enlarge   bool
+	Format    imageType
+	// FormatSet is true when the resulting format was specified in the request
+	FormatSet bool
+	Quality   int
+	// QualitySet is true when the quality was specified in the request or a preset
+	QualitySet bool
+	// MaxBytes is the size budget of the result. MaxBytesResize allows
+	// to reduce the dimensions when reducing the quality isn't enough
+	MaxBytes       int
+	MaxBytesResize bool
+	// Autoquality picks the quality for the image when it isn't specified explicitly.
+	// AutoqualityTarget is the maximal DSSIM of the result
+	Autoquality       autoqualityMethod
+	AutoqualityTarget float64
+	Page              int
+	DPI               float64
+
+	VideoSecond float64
+
+	Dpr    float64
+	Kernel resamplingKernel
+
+	Trim          bool
+	TrimThreshold float64
+	TrimColor     rgbColor
+	// TrimColorSet is false when the trim color should be detected automatically
+	TrimColorSet bool
+
+	CropWidth   int
+	CropHeight  int
+	CropGravity gravityOptions
+	CropOffset  bool
+	CropX       int
+	CropY       int
+
+	AspectRatio float64
+
+	Rotate           float64
+	RotateFill       bool
+	RotateBackground rgbColor
+
+	Flip bool
+	Flop bool
+
+	// Flatten is true when the background was specified in the request
+	Flatten    bool
+	Background rgbColor
+
+	Extend            bool
+	ExtendGravity     gravityType
+	ExtendAspectRatio float64
+
+	Text        string
+	TextFont    string
+	TextSize    int
+	TextColor   rgbColor
+	TextGravity gravityType
+	TextPadding int
+
+	BorderWidth int
+	BorderColor rgbColor
+
+	CornerRadius int
+	// Circle makes the image an ellipse inscribed in it, which is a circle for square images
+	Circle bool
+	// CornersFill is true when the corners should be filled with CornersBackground
+	// instead of being transparent
+	CornersFill       bool
+	CornersBackground rgbColor
+	PadBackground     paddingBackground
+
+	PaletteColors int
+	Dither        float64
+
+	JpegProgressive bool
+	JpegNoSubsample bool
+	PngInterlaced   bool
+	WebpLossless    bool
+
+	Denoise      int
+	Blur         float64
+	Saturation   float64
+	Brightness   float64
+	Contrast     float64
+	Gamma        float64
+	AutoContrast bool
+	Equalize     equalizeType
+
+	Vignette      float64
+	VignetteColor rgbColor
+
+	Metadata metadataPolicy
+	// KeepCopyright makes the strip policy keep the copyright and artist EXIF fields
+	KeepCopyright bool
+	// KeepIcc makes the strip policy keep the ICC profile. RGB images aren't converted
+	// to sRGB then, so wide gamut images keep their colors
+	KeepIcc bool
+
+	Watermark watermarkOptions
+	// Layers are the downloaded images composited over the result after the watermark
+	Layers []watermarkOptions
+
+	VariantGroup string
+	Variant      string
+
+	// TTL is the lifetime of the response in caches. TTLSet is true when it was specified
+	// in the request or a preset, so it takes precedence over the source response headers
+	TTL    int
+	TTLSet bool
+
+	// Filename is the name of the resulting file without the extension.
+	// If it's empty, the name of the source file is used
+	Filename string
+	// ReturnAttachment makes browsers download the image instead of showing it
+	ReturnAttachment bool
+
+	// CacheBuster doesn't affect processing, it only changes the URL and the ETag
+	CacheBuster string
+
+	// Pipelines are processed one by one before the rest of the options,
+	// each of them gets the result of the previous one
+	Pipelines []processingOptions
+
+	Timeout          int
+	MaxSrcDimension  int
+	MaxSrcResolution int
 }
 
 var vipsSupportSmartcrop bool
@@ -115,6 +389,25 @@ func initVips() {
 	if int(C.vips_type_find_load_go(C.GIF)) != 0 {
 		vipsTypeSupportLoad[GIF] = true
 	}
+	if int(C.vips_type_find_load_go(C.TIFF)) != 0 {
+		vipsTypeSupportLoad[TIFF] = true
+	}
+	if int(C.vips_type_find_load_go(C.PDF)) != 0 {
+		vipsTypeSupportLoad[PDF] = true
+	}
+	if int(C.vips_type_find_load_go(C.AVIF)) != 0 {
+		vipsTypeSupportLoad[AVIF] = true
+	}
+	if int(C.vips_type_find_load_go(C.HEIF)) != 0 {
+		vipsTypeSupportLoad[HEIF] = true
+	}
+	if int(C.vips_type_find_load_go(C.SVG)) != 0 {
+		vipsTypeSupportLoad[SVG] = true
+	}
+	if int(C.vips_type_find_load_go(C.BMP)) != 0 {
+		vipsTypeSupportLoad[BMP] = true
+		vipsTypeSupportLoad[ICO] = true
+	}
 
 	if int(C.vips_type_find_save_go(C.JPEG)) != 0 {
 		vipsTypeSupportSave[JPEG] = true
@@ -125,14 +418,46 @@ func initVips() {
 	if int(C.vips_type_find_save_go(C.WEBP)) != 0 {
 		vipsTypeSupportSave[WEBP] = true
 	}
+	if int(C.vips_type_find_save_go(C.AVIF)) != 0 {
+		vipsTypeSupportSave[AVIF] = true
+	}
+	if int(C.vips_type_find_save_go(C.JXL)) != 0 {
+		vipsTypeSupportSave[JXL] = true
+	}
 }
 
 func shutdownVips() {
 	C.vips_shutdown()
 }
 
+type vipsCacheInfo struct {
+	Size   int `json:"size"`
+	Max    int `json:"max"`
+	MaxMem int `json:"max_mem"`
+}
+
+func vipsCacheStats() vipsCacheInfo {
+	return vipsCacheInfo{
+		Size:   int(C.vips_cache_get_size()),
+		Max:    int(C.vips_cache_get_max()),
+		MaxMem: int(C.vips_cache_get_max_mem()),
+	}
+}
+
+func vipsCacheDropAll() {
+	C.vips_cache_drop_all()
+}
+
+func vipsTrackedMem() int {
+	return int(C.vips_tracked_get_mem())
+}
+
+func vipsTrackedMemHighwater() int {
+	return int(C.vips_tracked_get_mem_highwater())
+}
+
 func randomAccessRequired(po processingOptions) int {
-	if po.Gravity == SMART {
+	if po.Gravity.Type == SMART {
 		return 1
 	}
 	return 0
@@ -142,13 +467,19 @@ func round(f float64) int {
 	return int(f + .5)
 }
 
-func extractMeta(img *C.VipsImage) (int, int, int, bool) {
+// extractMeta returns the oriented dimensions of the image and the transformations
+// needed to orient it. The orientation is ignored if autoRotate is false
+func extractMeta(img *C.VipsImage, autoRotate bool) (int, int, int, bool) {
 	width := int(img.Xsize)
 	height := int(img.Ysize)
 
 	angle := C.VIPS_ANGLE_D0
 	flip := false
 
+	if !autoRotate {
+		return width, height, angle, flip
+	}
+
 	orientation := C.vips_get_exif_orientation(img)
 	if orientation >= 5 && orientation <= 8 {
 		width, height = height, width
@@ -169,8 +500,27 @@ func extractMeta(img *C.VipsImage) (int, int, int, bool) {
 	return width, height, angle, flip
 }
 
+// splitRotation splits the rotation angle into the multiple of 90 degrees
+// and the rest that requires rotation by an arbitrary angle
+func splitRotation(rotate float64) (int, float64) {
+	if math.Mod(rotate, 90) != 0 {
+		return C.VIPS_ANGLE_D0, rotate
+	}
+
+	switch int(rotate) {
+	case 90:
+		return C.VIPS_ANGLE_D90, 0
+	case 180:
+		return C.VIPS_ANGLE_D180, 0
+	case 270:
+		return C.VIPS_ANGLE_D270, 0
+	}
+
+	return C.VIPS_ANGLE_D0, 0
+}
+
 func calcScale(width, height int, po processingOptions) float64 {
-	if (po.Width == width && po.Height == height) || (po.Resize != FILL && po.Resize != FIT) {
+	if (po.Width == width && po.Height == height) || po.Resize == CROP {
 		return 1
 	}
 
@@ -179,7 +529,7 @@ func calcScale(width, height int, po processingOptions) float64 {
 	wr := fow / fsw
 	hr := foh / fsh
 
-	if po.Resize == FIT {
+	if po.Resize == FIT || po.Resize == LETTERBOX {
 		return math.Min(wr, hr)
 	}
 
@@ -205,49 +555,440 @@ func calcShink(scale float64, imgtype imageType) int {
 	return 1
 }
 
-func calcCrop(width, height int, po processingOptions) (left, top int) {
-	left = (width - po.Width + 1) / 2
-	top = (height - po.Height + 1) / 2
+func calcSize(width, height int, po *processingOptions) {
+	if po.Resize == CROP {
+		if po.Width == 0 {
+			po.Width = width
+		}
+		if po.Height == 0 {
+			po.Height = height
+		}
+		return
+	}
 
-	if po.Gravity == NORTH {
-		top = 0
+	switch {
+	case po.Width == 0 && po.Height == 0:
+		po.Width, po.Height = width, height
+	case po.Width == 0:
+		po.Width = round(float64(width) * float64(po.Height) / float64(height))
+	case po.Height == 0:
+		po.Height = round(float64(height) * float64(po.Width) / float64(width))
+	}
+
+	// Grow the requested size keeping the source aspect ratio,
+	// so fit produces the image not smaller than the minimal size
+	if po.Resize == FIT && (po.MinWidth > 0 || po.MinHeight > 0) {
+		fsw, fsh := float64(width), float64(height)
+
+		fitScale := math.Min(float64(po.Width)/fsw, float64(po.Height)/fsh)
+		minScale := math.Max(float64(po.MinWidth)/fsw, float64(po.MinHeight)/fsh)
+
+		if minScale > fitScale {
+			po.Width = round(fsw * minScale)
+			po.Height = round(fsh * minScale)
+		}
+	}
+}
+
+// canReturnSource returns true if the options don't change the pixels and the metadata of the image,
+// so it doesn't need to be saved again. The geometry is checked by the caller
+func canReturnSource(img *C.struct__VipsImage, po processingOptions) bool {
+	if po.Page > 0 || C.vips_get_n_pages(img) > 1 || len(po.Pipelines) > 0 {
+		return false
+	}
+
+	// The quality or the palette was requested explicitly, so the image should be saved with them
+	if po.QualitySet || po.Autoquality != AUTOQUALITY_NONE || po.PaletteColors > 0 {
+		return false
+	}
+
+	// The saving options can't be checked on the source image, so it's saved with them anyway
+	switch po.Format {
+	case JPEG:
+		if po.JpegProgressive || po.JpegNoSubsample {
+			return false
+		}
+	case PNG:
+		if po.PngInterlaced {
+			return false
+		}
+	case WEBP:
+		if po.WebpLossless {
+			return false
+		}
+	}
+
+	if po.Metadata != METADATA_KEEP && C.vips_has_metadata(img) != 0 {
+		return false
+	}
+
+	if vipsNeedColourProfileImport(img, po.KeepIcc) {
+		return false
+	}
+
+	if po.Flatten && vipsImageHasAlpha(img) {
+		return false
+	}
+
+	return !po.Flip && !po.Flop && po.Denoise == 0 && po.Blur == 0 && !po.AutoContrast &&
+		po.Equalize == EQUALIZE_NONE && po.Brightness == 0 && po.Contrast == 1 && po.Gamma == 1 &&
+		po.Saturation == 1 && po.Vignette == 0 && po.ExtendAspectRatio == 0 &&
+		len(po.Watermark.Name) == 0 && len(po.Watermark.URL) == 0 && len(po.Layers) == 0 &&
+		len(po.Text) == 0 && po.BorderWidth == 0 && po.CornerRadius == 0 && !po.Circle
+}
+
+// loadEmbeddedThumbnail replaces the image with the embedded EXIF thumbnail
+// if it has the same aspect ratio and is big enough for the requested size
+func loadEmbeddedThumbnail(img **C.struct__VipsImage, data []byte, width, height int, swapDims bool, po processingOptions) ([]byte, int, int) {
+	// The thumbnail has neither the color profile nor the metadata of the source image,
+	// so it can't be used if any of them affect the result
+	if C.vips_has_icc_profile(*img) != 0 || po.Metadata != METADATA_STRIP || po.KeepCopyright {
+		return data, width, height
+	}
+
+	thumb, ok := extractJPEGThumbnail(data)
+	if !ok {
+		return data, width, height
+	}
+
+	tmp, err := vipsLoadImage(thumb, JPEG, 1, 0)
+	if err != nil {
+		C.vips_error_clear()
+		return data, width, height
 	}
 
-	if po.Gravity == EAST {
-		left = width - po.Width
+	thumbWidth, thumbHeight := int(tmp.Xsize), int(tmp.Ysize)
+	if swapDims {
+		thumbWidth, thumbHeight = thumbHeight, thumbWidth
 	}
 
-	if po.Gravity == SOUTH {
-		top = height - po.Height
+	scale := calcScale(width, height, po)
+	aspectDiff := float64(thumbWidth)/float64(thumbHeight) - float64(width)/float64(height)
+
+	if float64(thumbWidth) < float64(width)*scale || float64(thumbHeight) < float64(height)*scale || math.Abs(aspectDiff) > 0.01 {
+		C.clear_image(&tmp)
+		return data, width, height
+	}
+
+	C.swap_and_clear(img, tmp)
+
+	return thumb, thumbWidth, thumbHeight
+}
+
+// calcPosition calculates the position of the inner area inside the outer one
+func calcPosition(width, height, innerWidth, innerHeight int, gravity gravityType) (left, top int) {
+	left = (width - innerWidth + 1) / 2
+	top = (height - innerHeight + 1) / 2
+
+	switch gravity {
+	case NORTH, NORTH_EAST, NORTH_WEST:
+		top = 0
+	case SOUTH, SOUTH_EAST, SOUTH_WEST:
+		top = height - innerHeight
 	}
 
-	if po.Gravity == WEST {
+	switch gravity {
+	case EAST, NORTH_EAST, SOUTH_EAST:
+		left = width - innerWidth
+	case WEST, NORTH_WEST, SOUTH_WEST:
 		left = 0
 	}
 
 	return
 }
 
+// rotateRect rotates the rectangle inside of the image of the given size by the given angle
+func rotateRect(left, top, width, height, imgWidth, imgHeight, angle int) (int, int, int, int) {
+	switch angle {
+	case C.VIPS_ANGLE_D90:
+		return imgHeight - top - height, left, height, width
+	case C.VIPS_ANGLE_D180:
+		return imgWidth - left - width, imgHeight - top - height, width, height
+	case C.VIPS_ANGLE_D270:
+		return top, imgWidth - left - width, height, width
+	}
+
+	return left, top, width, height
+}
+
+// orientRect transforms the rectangle of the loaded image into the coordinates of the oriented one
+func orientRect(left, top, width, height int, img *C.struct__VipsImage, angle int, flip bool, userAngle int, po processingOptions) (int, int, int, int) {
+	imgWidth, imgHeight := int(img.Xsize), int(img.Ysize)
+
+	rotate := func(a int) {
+		left, top, width, height = rotateRect(left, top, width, height, imgWidth, imgHeight, a)
+		if a == C.VIPS_ANGLE_D90 || a == C.VIPS_ANGLE_D270 {
+			imgWidth, imgHeight = imgHeight, imgWidth
+		}
+	}
+
+	rotate(angle)
+	if flip {
+		left = imgWidth - left - width
+	}
+	rotate(userAngle)
+	if po.Flip {
+		top = imgHeight - top - height
+	}
+	if po.Flop {
+		left = imgWidth - left - width
+	}
+
+	return left, top, width, height
+}
+
+// calcCropSize calculates the size of the explicit crop. Zero or too big dimensions
+// are replaced with the source ones
+func calcCropSize(width, height int, po processingOptions) (int, int) {
+	cropWidth, cropHeight := po.CropWidth, po.CropHeight
+
+	if cropWidth <= 0 || cropWidth > width {
+		cropWidth = width
+	}
+	if cropHeight <= 0 || cropHeight > height {
+		cropHeight = height
+	}
+
+	return cropWidth, cropHeight
+}
+
+func calcAspectRatioCrop(width, height int, ratio float64) (int, int) {
+	if float64(width)/float64(height) > ratio {
+		return maxInt(round(float64(height)*ratio), 1), height
+	}
+
+	return width, maxInt(round(float64(width)/ratio), 1)
+}
+
+func calcAspectRatioExtend(width, height int, ratio float64) (int, int) {
+	if float64(width)/float64(height) > ratio {
+		return width, maxInt(round(float64(width)/ratio), height)
+	}
+
+	return maxInt(round(float64(height)*ratio), width), height
+}
+
+// calcGravityPosition is calcPosition that supports gravity arguments
+func calcGravityPosition(width, height, innerWidth, innerHeight int, gravity gravityOptions) (left, top int) {
+	if gravity.Type == FOCUS_POINT {
+		left = round(gravity.X*float64(width) - float64(innerWidth)/2)
+		top = round(gravity.Y*float64(height) - float64(innerHeight)/2)
+
+		left = maxInt(0, minInt(left, width-innerWidth))
+		top = maxInt(0, minInt(top, height-innerHeight))
+
+		return
+	}
+
+	left, top = calcPosition(width, height, innerWidth, innerHeight, gravity.Type)
+
+	// Offsets move the area away from the anchor edge, towards the center for the central gravities
+	offX, offY := round(gravity.X), round(gravity.Y)
+
+	switch gravity.Type {
+	case EAST, NORTH_EAST, SOUTH_EAST:
+		left -= offX
+	default:
+		left += offX
+	}
+
+	switch gravity.Type {
+	case SOUTH, SOUTH_EAST, SOUTH_WEST:
+		top -= offY
+	default:
+		top += offY
+	}
+
+	left = maxInt(0, minInt(left, width-innerWidth))
+	top = maxInt(0, minInt(top, height-innerHeight))
+
+	return
+}
+
+func calcCrop(width, height int, po processingOptions) (left, top int) {
+	return calcGravityPosition(width, height, po.Width, po.Height, po.Gravity)
+}
+
 func processImage(data []byte, imgtype imageType, po processingOptions, t *timer) ([]byte, error) {
 	defer C.vips_cleanup()
 	defer keepAlive(data)
 
-	if po.Gravity == SMART && !vipsSupportSmartcrop {
+	var err error
+
+	for _, pipeline := range po.Pipelines {
+		if data, err = processImage(data, imgtype, pipeline, t); err != nil {
+			return nil, err
+		}
+		imgtype = pipeline.Format
+
+		defer keepAlive(data)
+	}
+
+	// SVG images are sanitized and passed through as is
+	if po.Format == SVG {
+		if imgtype != SVG {
+			return nil, errors.New("Only SVG images can be converted to SVG")
+		}
+		return sanitizeSVG(data)
+	}
+
+	if (po.Gravity.Type == SMART || po.CropGravity.Type == SMART) && !vipsSupportSmartcrop {
 		return nil, errors.New("Smart crop is not supported by used version of libvips")
 	}
 
-	img, err := vipsLoadImage(data, imgtype, 1)
+	var img *C.struct__VipsImage
+
+	// Videos are processed as their frame
+	if imgtype == VIDEO {
+		if data, err = extractVideoFrame(data, po.VideoSecond, time.Duration(po.Timeout)*time.Second); err != nil {
+			return nil, err
+		}
+		imgtype = PNG
+
+		defer keepAlive(data)
+
+		t.Check()
+	}
+
+	vector := isVectorType(imgtype)
+
+	if vector {
+		img, err = vipsLoadVector(data, imgtype, 0, 1, po.DPI)
+	} else {
+		img, err = vipsLoadImage(data, imgtype, 1, 0)
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer C.clear_image(&img)
 
+	if po.Page > 0 {
+		if pages := int(C.vips_get_n_pages(img)); po.Page >= pages {
+			return nil, fmt.Errorf("Page %d is out of range, the source image has %d page(s)", po.Page, pages)
+		}
+
+		var tmp *C.struct__VipsImage
+		var e error
+
+		if vector {
+			tmp, e = vipsLoadVector(data, imgtype, po.Page, 1, po.DPI)
+		} else {
+			tmp, e = vipsLoadImage(data, imgtype, 1, po.Page)
+		}
+		if e != nil {
+			return nil, e
+		}
+		C.swap_and_clear(&img, tmp)
+	}
+
 	t.Check()
 
-	imgWidth, imgHeight, angle, flip := extractMeta(img)
+	imgWidth, imgHeight, angle, flip := extractMeta(img, !conf.DisableAutoRotate)
+
+	// Rotations by multiples of 90 degrees are applied along with the EXIF orientation,
+	// so the rest of calculations should be done with the rotated dimensions
+	userAngle, freeAngle := splitRotation(po.Rotate)
+	if userAngle == C.VIPS_ANGLE_D90 || userAngle == C.VIPS_ANGLE_D270 {
+		imgWidth, imgHeight = imgHeight, imgWidth
+	}
+
+	// Should we swap the dimensions of the loaded image to get the oriented ones
+	swapDims := (angle == C.VIPS_ANGLE_D90 || angle == C.VIPS_ANGLE_D270) != (userAngle == C.VIPS_ANGLE_D90 || userAngle == C.VIPS_ANGLE_D270)
+
+	// Some formats like PDF or HEIF don't provide dimensions before loading, so we check them here
+	if imgWidth > po.MaxSrcDimension || imgHeight > po.MaxSrcDimension || imgWidth*imgHeight > po.MaxSrcResolution {
+		return nil, errors.New("Source image is too big")
+	}
+
+	srcWidth, srcHeight := imgWidth, imgHeight
+	cropLeft, cropTop := 0, 0
+	hasCrop := po.CropWidth > 0 || po.CropHeight > 0
+	trimmed := false
+
+	// Trimmed area is the base for the rest of crops
+	if po.Trim {
+		left, top, width, height, e := vipsFindTrim(img, po)
+		if e != nil {
+			return nil, e
+		}
+
+		// Zero size means the whole image is of the trim color, so there is nothing to keep
+		if width > 0 && height > 0 && (width != int(img.Xsize) || height != int(img.Ysize)) {
+			cropLeft, cropTop, imgWidth, imgHeight = orientRect(left, top, width, height, img, angle, flip, userAngle, po)
+			trimmed = true
+		}
+	}
+
+	// The explicit and the aspect ratio crops are applied after resizing to keep
+	// shrink-on-load working, so we calculate the rest as if the source was already cropped
+	if hasCrop {
+		width, height := calcCropSize(imgWidth, imgHeight, po)
+
+		if po.CropOffset {
+			cropLeft += minInt(po.CropX, imgWidth-width)
+			cropTop += minInt(po.CropY, imgHeight-height)
+		} else {
+			left, top := calcGravityPosition(imgWidth, imgHeight, width, height, po.CropGravity)
+			cropLeft += left
+			cropTop += top
+		}
+
+		imgWidth, imgHeight = width, height
+	}
+
+	if po.AspectRatio > 0 {
+		width, height := calcAspectRatioCrop(imgWidth, imgHeight, po.AspectRatio)
+		left, top := calcGravityPosition(imgWidth, imgHeight, width, height, po.Gravity)
+
+		imgWidth, imgHeight = width, height
+		cropLeft += left
+		cropTop += top
+	}
+
+	// Smart crop can be used only when the crop area isn't limited by an explicit crop or trimming
+	smartCrop := !trimmed && ((hasCrop && po.AspectRatio == 0 && !po.CropOffset && po.CropGravity.Type == SMART) ||
+		(!hasCrop && po.Gravity.Type == SMART))
+
+	if po.Dpr != 1 {
+		po.Width = int(float64(po.Width) * po.Dpr)
+		po.Height = int(float64(po.Height) * po.Dpr)
+		po.MinWidth = int(float64(po.MinWidth) * po.Dpr)
+		po.MinHeight = int(float64(po.MinHeight) * po.Dpr)
+	}
+
+	// Auto fills the requested size when the orientations of the source and the result match
+	if po.Resize == AUTO {
+		if po.Width > 0 && po.Height > 0 && (po.Width > po.Height) == (imgWidth > imgHeight) {
+			po.Resize = FILL
+		} else {
+			po.Resize = FIT
+		}
+	}
+
+	// Calculate missing dimensions using the source aspect ratio
+	calcSize(imgWidth, imgHeight, &po)
+
+	if po.Width > conf.MaxResultWidth || po.Height > conf.MaxResultHeight || po.Width*po.Height > conf.MaxResultResolution {
+		return nil, errors.New("Result image is too big")
+	}
+
+	// Fill-down never enlarges the image, so the requested size is reduced
+	// to fit the source keeping the requested aspect ratio
+	if po.Resize == FILL_DOWN {
+		if imgWidth < po.Width || imgHeight < po.Height {
+			ratio := math.Min(float64(imgWidth)/float64(po.Width), float64(imgHeight)/float64(po.Height))
+			po.Width = maxInt(round(float64(po.Width)*ratio), 1)
+			po.Height = maxInt(round(float64(po.Height)*ratio), 1)
+		}
+		po.Resize = FILL
+	}
+
+	// Letterbox and extend always produce the requested canvas, even if the image isn't enlarged
+	canvasWidth, canvasHeight := po.Width, po.Height
 
-	// Ensure we won't crop out of bounds
-	if !po.Enlarge || po.Resize == CROP {
+	// Ensure we won't crop out of bounds.
+	// Vector images are rasterized at the requested size, so they can always be enlarged
+	if (!po.Enlarge && !vector) || po.Resize == CROP {
 		if imgWidth < po.Width {
 			po.Width = imgWidth
 		}
@@ -257,24 +998,70 @@ func processImage(data []byte, imgtype imageType, po processingOptions, t *timer
 		}
 	}
 
-	if po.Width != imgWidth || po.Height != imgHeight {
-		if po.Resize == FILL || po.Resize == FIT {
-			scale := calcScale(imgWidth, imgHeight, po)
+	// When nothing changes the image, the source is returned as is to avoid generation loss
+	if imgtype == po.Format && po.Width == imgWidth && po.Height == imgHeight &&
+		imgWidth == srcWidth && imgHeight == srcHeight && canvasWidth == imgWidth && canvasHeight == imgHeight &&
+		angle == C.VIPS_ANGLE_D0 && !flip && userAngle == C.VIPS_ANGLE_D0 && freeAngle == 0 &&
+		(po.MaxBytes == 0 || len(data) <= po.MaxBytes) && canReturnSource(img, po) {
+		return data, nil
+	}
+
+	if conf.UseEmbeddedThumbnails && imgtype == JPEG && po.AspectRatio == 0 && !hasCrop && !trimmed && po.Resize != CROP {
+		data, imgWidth, imgHeight = loadEmbeddedThumbnail(&img, data, imgWidth, imgHeight, swapDims, po)
+		// The thumbnail replaces the source, so it shouldn't be treated as an aspect ratio crop
+		srcWidth, srcHeight = imgWidth, imgHeight
+	}
+
+	srcCrop := imgWidth != srcWidth || imgHeight != srcHeight
+
+	// The image should be oriented even if it isn't resized
+	orient := angle != C.VIPS_ANGLE_D0 || flip || userAngle != C.VIPS_ANGLE_D0 || po.Flip || po.Flop
+
+	// CMYK and wide gamut images are converted to sRGB even if they aren't resized
+	if po.Width != imgWidth || po.Height != imgHeight || po.Denoise > 0 || srcCrop || orient || vipsNeedColourProfileImport(img, po.KeepIcc) {
+		scale := 1.0
+		downscaled := false
+
+		if po.Resize != CROP {
+			scale = calcScale(imgWidth, imgHeight, po)
+			downscaled = scale < 1.0
+
+			// Rasterize vector images at the resulting scale so they stay crisp
+			if vector && scale != 1.0 {
+				if tmp, e := vipsLoadVector(data, imgtype, po.Page, scale, po.DPI); e == nil {
+					C.swap_and_clear(&img, tmp)
+					scale = 1.0
+				} else {
+					return nil, e
+				}
+			}
 
-			// Do some shrink-on-load
-			if scale < 1.0 {
+			// Do some shrink-on-load. Loaders shrink images with their own filters,
+			// so it's skipped for nearest neighbour to keep the pixels sharp
+			if scale < 1.0 && po.Kernel != NEAREST {
 				if imgtype == JPEG || imgtype == WEBP {
 					shrink := calcShink(scale, imgtype)
 					scale = scale * float64(shrink)
 
-					if tmp, e := vipsLoadImage(data, imgtype, shrink); e == nil {
+					if tmp, e := vipsLoadImage(data, imgtype, shrink, po.Page); e == nil {
 						C.swap_and_clear(&img, tmp)
 					} else {
 						return nil, e
 					}
 				}
 			}
+		}
+
+		// Denoise before downscaling so the noise doesn't get baked into the result
+		if po.Denoise > 0 {
+			if err = vipsDenoise(&img, po.Denoise); err != nil {
+				return nil, err
+			}
+		}
+
+		t.Check()
 
+		if po.Resize != CROP {
 			premultiplied := false
 			var bandFormat C.VipsBandFormat
 
@@ -285,7 +1072,25 @@ func processImage(data []byte, imgtype imageType, po processingOptions, t *timer
 				premultiplied = true
 			}
 
-			if err = vipsResize(&img, scale); err != nil {
+			hscale, vscale := scale, scale
+
+			// Force ignores the aspect ratio, so we calculate scales for both axes
+			// using the actual (possibly shrunk on load) image size
+			if po.Resize == FORCE {
+				curWidth, curHeight := float64(img.Xsize), float64(img.Ysize)
+				if swapDims {
+					curWidth, curHeight = curHeight, curWidth
+				}
+
+				hscale = float64(po.Width) / (float64(imgWidth) * curWidth / float64(srcWidth))
+				vscale = float64(po.Height) / (float64(imgHeight) * curHeight / float64(srcHeight))
+
+				if swapDims {
+					hscale, vscale = vscale, hscale
+				}
+			}
+
+			if err = vipsResize(&img, hscale, vscale, po.Kernel); err != nil {
 				return nil, err
 			}
 
@@ -296,7 +1101,7 @@ func processImage(data []byte, imgtype imageType, po processingOptions, t *timer
 			}
 		}
 
-		if err = vipsImportColourProfile(&img); err != nil {
+		if err = vipsImportColourProfile(&img, po.KeepIcc); err != nil {
 			return nil, err
 		}
 
@@ -304,9 +1109,16 @@ func processImage(data []byte, imgtype imageType, po processingOptions, t *timer
 			return nil, err
 		}
 
+		// Downscaling softens the image, so we restore the crispness
+		if downscaled && conf.UnsharpRadius > 0 && po.Kernel != NEAREST {
+			if err = vipsUnsharp(&img, conf.UnsharpRadius, conf.UnsharpAmount, conf.UnsharpThreshold); err != nil {
+				return nil, err
+			}
+		}
+
 		t.Check()
 
-		if angle != C.VIPS_ANGLE_D0 || flip {
+		if orient {
 			if err = vipsImageCopyMemory(&img); err != nil {
 				return nil, err
 			}
@@ -322,19 +1134,72 @@ func processImage(data []byte, imgtype imageType, po processingOptions, t *timer
 					return nil, err
 				}
 			}
-		}
 
-		t.Check()
+			if userAngle != C.VIPS_ANGLE_D0 {
+				if err = vipsRotate(&img, userAngle); err != nil {
+					return nil, err
+				}
+			}
 
-		if po.Resize == FILL || po.Resize == CROP {
-			if po.Gravity == SMART {
-				if err = vipsImageCopyMemory(&img); err != nil {
+			if po.Flip {
+				if err = vipsFlipVertical(&img); err != nil {
 					return nil, err
 				}
-				if err = vipsSmartCrop(&img, po.Width, po.Height); err != nil {
+			}
+
+			if po.Flop {
+				if err = vipsFlip(&img); err != nil {
 					return nil, err
 				}
-			} else {
+			}
+
+			// The image is rotated already, so it shouldn't be rotated again by viewers
+			if po.Metadata != METADATA_STRIP {
+				if err = vipsResetOrientation(&img); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		t.Check()
+
+		if srcCrop {
+			xfactor := float64(img.Xsize) / float64(srcWidth)
+			yfactor := float64(img.Ysize) / float64(srcHeight)
+			cropWidth := minInt(round(float64(imgWidth)*xfactor), int(img.Xsize))
+			cropHeight := minInt(round(float64(imgHeight)*yfactor), int(img.Ysize))
+
+			// Don't let rounding make the image smaller than the following crop
+			if po.Resize == FILL || po.Resize == CROP {
+				cropWidth = minInt(maxInt(cropWidth, po.Width), int(img.Xsize))
+				cropHeight = minInt(maxInt(cropHeight, po.Height), int(img.Ysize))
+			}
+
+			if smartCrop {
+				if err = vipsImageCopyMemory(&img); err != nil {
+					return nil, err
+				}
+				if err = vipsSmartCrop(&img, cropWidth, cropHeight); err != nil {
+					return nil, err
+				}
+			} else {
+				left := minInt(round(float64(cropLeft)*xfactor), int(img.Xsize)-cropWidth)
+				top := minInt(round(float64(cropTop)*yfactor), int(img.Ysize)-cropHeight)
+				if err = vipsCrop(&img, left, top, cropWidth, cropHeight); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if po.Resize == FILL || po.Resize == CROP {
+			if po.Gravity.Type == SMART {
+				if err = vipsImageCopyMemory(&img); err != nil {
+					return nil, err
+				}
+				if err = vipsSmartCrop(&img, po.Width, po.Height); err != nil {
+					return nil, err
+				}
+			} else {
 				left, top := calcCrop(int(img.Xsize), int(img.Ysize), po)
 				if err = vipsCrop(&img, left, top, po.Width, po.Height); err != nil {
 					return nil, err
@@ -343,20 +1208,332 @@ func processImage(data []byte, imgtype imageType, po processingOptions, t *timer
 		}
 	}
 
+	if freeAngle != 0 {
+		if err = vipsRotateFill(&img, freeAngle, po.RotateFill, po.RotateBackground); err != nil {
+			return nil, err
+		}
+	}
+
+	if po.Blur > 0 {
+		if err = vipsBlur(&img, po.Blur); err != nil {
+			return nil, err
+		}
+	}
+
+	if po.AutoContrast {
+		if err = vipsAutoContrast(&img); err != nil {
+			return nil, err
+		}
+	}
+
+	if po.Equalize != EQUALIZE_NONE {
+		if err = vipsEqualize(&img, po.Equalize); err != nil {
+			return nil, err
+		}
+	}
+
+	if po.Brightness != 0 || po.Contrast != 1 || po.Gamma != 1 {
+		if err = vipsAdjust(&img, po.Brightness, po.Contrast, po.Gamma); err != nil {
+			return nil, err
+		}
+	}
+
+	if po.Saturation != 1 {
+		if err = vipsSaturation(&img, po.Saturation); err != nil {
+			return nil, err
+		}
+	}
+
+	if po.Vignette > 0 {
+		if err = vipsVignette(&img, po.Vignette, po.VignetteColor); err != nil {
+			return nil, err
+		}
+	}
+
+	if (po.Resize == LETTERBOX || po.Extend) && (int(img.Xsize) != canvasWidth || int(img.Ysize) != canvasHeight) {
+		gravity := po.Gravity.Type
+		if po.Extend {
+			gravity = po.ExtendGravity
+		}
+
+		left, top := calcPosition(canvasWidth, canvasHeight, int(img.Xsize), int(img.Ysize), gravity)
+		if err = vipsPad(&img, canvasWidth, canvasHeight, left, top, po.PadBackground); err != nil {
+			return nil, err
+		}
+	}
+
+	if po.ExtendAspectRatio > 0 {
+		width, height := int(img.Xsize), int(img.Ysize)
+		canvasWidth, canvasHeight := calcAspectRatioExtend(width, height, po.ExtendAspectRatio)
+
+		if canvasWidth > conf.MaxResultWidth || canvasHeight > conf.MaxResultHeight || canvasWidth*canvasHeight > conf.MaxResultResolution {
+			return nil, errors.New("Result image is too big")
+		}
+
+		if canvasWidth != width || canvasHeight != height {
+			left, top := calcPosition(canvasWidth, canvasHeight, width, height, po.Gravity.Type)
+			if err = vipsPad(&img, canvasWidth, canvasHeight, left, top, po.PadBackground); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t.Check()
+
+	if len(po.Watermark.Name) > 0 || len(po.Watermark.URL) > 0 {
+		wm := watermarks[po.Watermark.Name]
+
+		if len(po.Watermark.URL) > 0 {
+			if wm, err = getURLWatermark(po.Watermark.URL, po); err != nil {
+				return nil, err
+			}
+		}
+
+		if err = vipsApplyWatermark(&img, wm, po.Watermark); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, layer := range po.Layers {
+		wm, e := getURLWatermark(layer.URL, po)
+		if e != nil {
+			return nil, e
+		}
+
+		if err = vipsApplyWatermark(&img, wm, layer); err != nil {
+			return nil, err
+		}
+	}
+
+	t.Check()
+
+	if len(po.Text) > 0 {
+		size := round(float64(po.TextSize) * po.Dpr)
+		padding := round(float64(po.TextPadding) * po.Dpr)
+
+		if err = vipsDrawText(&img, po.Text, po.TextFont, size, po.TextColor, po.TextGravity, padding); err != nil {
+			return nil, err
+		}
+	}
+
+	t.Check()
+
+	if po.BorderWidth > 0 {
+		border := round(float64(po.BorderWidth) * po.Dpr)
+		canvasWidth, canvasHeight := int(img.Xsize)+border*2, int(img.Ysize)+border*2
+
+		if canvasWidth > conf.MaxResultWidth || canvasHeight > conf.MaxResultHeight || canvasWidth*canvasHeight > conf.MaxResultResolution {
+			return nil, errors.New("Result image is too big")
+		}
+
+		if err = vipsPad(&img, canvasWidth, canvasHeight, border, border, paddingBackground{Color: po.BorderColor}); err != nil {
+			return nil, err
+		}
+	}
+
+	if po.CornerRadius > 0 || po.Circle {
+		width, height := int(img.Xsize), int(img.Ysize)
+
+		var rx, ry int
+		if po.Circle {
+			rx, ry = width/2, height/2
+		} else {
+			rx = minInt(round(float64(po.CornerRadius)*po.Dpr), minInt(width, height)/2)
+			ry = rx
+		}
+
+		if err = vipsRoundCorners(&img, rx, ry); err != nil {
+			return nil, err
+		}
+
+		if po.CornersFill {
+			if err = vipsFlatten(&img, po.CornersBackground); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// JPEG doesn't support transparency, so it's always flattened
+	if po.Flatten || po.Format == JPEG {
+		if err = vipsFlatten(&img, po.Background); err != nil {
+			return nil, err
+		}
+	}
+
+	t.Check()
+
+	if po.Metadata == METADATA_PRIVACY {
+		if err = vipsRemoveSensitiveMetadata(&img); err != nil {
+			return nil, err
+		}
+	}
+
+	if po.Metadata == METADATA_STRIP && (po.KeepCopyright || po.KeepIcc) {
+		if err = vipsStripMetadata(&img, po.KeepCopyright, po.KeepIcc); err != nil {
+			return nil, err
+		}
+	}
+
 	t.Check()
 
-	return vipsSaveImage(img, po.Format)
+	if po.Autoquality != AUTOQUALITY_NONE && !po.QualitySet {
+		if po.Quality, err = calcAutoquality(&img, po, t); err != nil {
+			return nil, err
+		}
+	}
+
+	if po.MaxBytes > 0 {
+		return saveImageToFitBytes(&img, po, t)
+	}
+
+	return vipsSaveImage(img, po)
+}
+
+// isLossy returns true if the quality affects the resulting image
+func isLossy(po processingOptions) bool {
+	return (po.Format == JPEG || po.Format == AVIF || po.Format == JXL) || (po.Format == WEBP && !po.WebpLossless)
+}
+
+// calcAutoquality finds the lowest quality between conf.AutoqualityMin and conf.AutoqualityMax
+// that keeps the DSSIM of the saved image not greater than po.AutoqualityTarget.
+// The quality is found with a binary search, so the image is saved and loaded several times
+func calcAutoquality(img **C.struct__VipsImage, po processingOptions, t *timer) (int, error) {
+	// We need to load the saved image back to compare it with the original one
+	if !isLossy(po) || !vipsTypeSupportLoad[po.Format] || C.vips_band_format(*img) != C.VIPS_FORMAT_UCHAR {
+		return po.Quality, nil
+	}
+
+	if err := vipsImageCopyMemory(img); err != nil {
+		return 0, err
+	}
+
+	low, high := conf.AutoqualityMin, conf.AutoqualityMax
+
+	for low < high {
+		po.Quality = (low + high) / 2
+
+		dssim, err := vipsSavedImageDSSIM(*img, po)
+		if err != nil {
+			return 0, err
+		}
+
+		if dssim <= po.AutoqualityTarget {
+			high = po.Quality
+		} else {
+			low = po.Quality + 1
+		}
+
+		t.Check()
+	}
+
+	return low, nil
+}
+
+// vipsSavedImageDSSIM saves the image with the given options and returns the DSSIM
+// of the saved image compared to the original one
+func vipsSavedImageDSSIM(img *C.struct__VipsImage, po processingOptions) (float64, error) {
+	data, err := vipsSaveImage(img, po)
+	if err != nil {
+		return 0, err
+	}
+
+	saved, err := vipsLoadImage(data, po.Format, 1, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer C.clear_image(&saved)
+
+	var dssim C.double
+
+	if C.vips_dssim_go(img, saved, &dssim) != 0 {
+		return 0, vipsError()
+	}
+
+	return float64(dssim), nil
 }
 
-func vipsLoadImage(data []byte, imgtype imageType, shrink int) (*C.struct__VipsImage, error) {
+// minMaxBytesQuality is the quality saveImageToFitBytes doesn't go below
+const minMaxBytesQuality = 10
+
+// saveImageToFitBytes lowers the quality and, if allowed, the dimensions of the image
+// until it fits po.MaxBytes. If it's impossible, the smallest result is returned
+func saveImageToFitBytes(img **C.struct__VipsImage, po processingOptions, t *timer) ([]byte, error) {
+	// The image is saved several times, so we don't want to process it again each time
+	if err := vipsImageCopyMemory(img); err != nil {
+		return nil, err
+	}
+
+	lossy := isLossy(po)
+
+	for {
+		result, err := vipsSaveImage(*img, po)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(result) <= po.MaxBytes {
+			return result, nil
+		}
+
+		t.Check()
+
+		delta := float64(len(result)) / float64(po.MaxBytes)
+
+		switch {
+		case lossy && po.Quality > minMaxBytesQuality:
+			switch {
+			case delta > 3:
+				delta = 0.25
+			case delta > 1.5:
+				delta = 0.5
+			default:
+				delta = 0.75
+			}
+			po.Quality = maxInt(int(float64(po.Quality)*delta), minMaxBytesQuality)
+		case po.MaxBytesResize && (*img).Xsize > 1 && (*img).Ysize > 1:
+			// The size of the encoded image is roughly proportional to its area
+			scale := math.Sqrt(1/delta) * 0.9
+			if err = vipsResize(img, scale, scale, po.Kernel); err != nil {
+				return nil, err
+			}
+			if err = vipsImageCopyMemory(img); err != nil {
+				return nil, err
+			}
+		default:
+			return result, nil
+		}
+	}
+}
+
+func vipsLoadImage(data []byte, imgtype imageType, shrink int, page int) (*C.struct__VipsImage, error) {
+	var img *C.struct__VipsImage
+	if C.vips_load_buffer(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(imgtype), C.int(shrink), C.int(page), &img) != 0 {
+		return nil, vipsError()
+	}
+	return img, nil
+}
+
+// isVectorType returns true if the images of the type can be rendered at any scale
+func isVectorType(imgtype imageType) bool {
+	return imgtype == SVG || imgtype == PDF
+}
+
+func vipsLoadVector(data []byte, imgtype imageType, page int, scale float64, dpi float64) (*C.struct__VipsImage, error) {
 	var img *C.struct__VipsImage
-	if C.vips_load_buffer(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(imgtype), C.int(shrink), &img) != 0 {
+
+	err := C.int(0)
+	if imgtype == PDF {
+		err = C.vips_pdfload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(page), C.double(scale), C.double(dpi), &img)
+	} else {
+		err = C.vips_svgload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.double(scale), C.double(dpi), &img)
+	}
+	if err != 0 {
 		return nil, vipsError()
 	}
 	return img, nil
 }
 
-func vipsSaveImage(img *C.struct__VipsImage, imgtype imageType) ([]byte, error) {
+func vipsSaveImage(img *C.struct__VipsImage, po processingOptions) ([]byte, error) {
 	var ptr unsafe.Pointer
 	defer C.g_free_go(&ptr)
 
@@ -364,13 +1541,20 @@ func vipsSaveImage(img *C.struct__VipsImage, imgtype imageType) ([]byte, error)
 
 	imgsize := C.size_t(0)
 
-	switch imgtype {
+	// The metadata is stripped already when some of it is kept
+	strip := cBool(po.Metadata == METADATA_STRIP && !po.KeepCopyright && !po.KeepIcc)
+
+	switch po.Format {
 	case JPEG:
-		err = C.vips_jpegsave_go(img, &ptr, &imgsize, 1, C.int(conf.Quality), 0)
+		err = C.vips_jpegsave_go(img, &ptr, &imgsize, strip, C.int(po.Quality), cBool(po.JpegProgressive), cBool(po.JpegNoSubsample))
 	case PNG:
-		err = C.vips_pngsave_go(img, &ptr, &imgsize)
+		err = C.vips_pngsave_go(img, &ptr, &imgsize, strip, C.int(po.PaletteColors), C.double(po.Dither), cBool(po.PngInterlaced))
 	case WEBP:
-		err = C.vips_webpsave_go(img, &ptr, &imgsize, 1, C.int(conf.Quality))
+		err = C.vips_webpsave_go(img, &ptr, &imgsize, strip, C.int(po.Quality), cBool(po.WebpLossless))
+	case AVIF:
+		err = C.vips_avifsave_go(img, &ptr, &imgsize, strip, C.int(po.Quality), C.int(conf.AvifEffort))
+	case JXL:
+		err = C.vips_jxlsave_go(img, &ptr, &imgsize, strip, C.int(po.Quality), C.int(conf.JxlEffort))
 	}
 	if err != 0 {
 		return nil, vipsError()
@@ -379,6 +1563,13 @@ func vipsSaveImage(img *C.struct__VipsImage, imgtype imageType) ([]byte, error)
 	return C.GoBytes(ptr, C.int(imgsize)), nil
 }
 
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func vipsImageHasAlpha(img *C.struct__VipsImage) bool {
 	return C.vips_image_hasalpha_go(img) > 0
 }
@@ -412,10 +1603,157 @@ func vipsUnpremultiply(img **C.struct__VipsImage, format C.VipsBandFormat) error
 	return nil
 }
 
-func vipsResize(img **C.struct__VipsImage, scale float64) error {
+func vipsResize(img **C.struct__VipsImage, hscale, vscale float64, kernel resamplingKernel) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_resize_go(*img, &tmp, C.double(hscale), C.double(vscale), C.VipsKernel(kernel)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsDenoise(img **C.struct__VipsImage, strength int) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_median_go(*img, &tmp, C.int(strength*2+1)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsFlatten(img **C.struct__VipsImage, bg rgbColor) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_flatten_go(*img, &tmp, C.int(bg.R), C.int(bg.G), C.int(bg.B)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsRoundCorners(img **C.struct__VipsImage, rx, ry int) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_round_corners_go(*img, &tmp, C.int(rx), C.int(ry)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsBlur(img **C.struct__VipsImage, sigma float64) error {
+	var tmp *C.struct__VipsImage
+
+	// Premultiply the image so transparent pixels don't bleed into the opaque ones
+	premultiplied := false
+	var bandFormat C.VipsBandFormat
+
+	if vipsImageHasAlpha(*img) {
+		var err error
+		if bandFormat, err = vipsPremultiply(img); err != nil {
+			return err
+		}
+		premultiplied = true
+	}
+
+	if C.vips_gaussblur_go(*img, &tmp, C.double(sigma)) != 0 {
+		return vipsError()
+	}
+	C.swap_and_clear(img, tmp)
+
+	if premultiplied {
+		return vipsUnpremultiply(img, bandFormat)
+	}
+
+	return nil
+}
+
+func vipsUnsharp(img **C.struct__VipsImage, radius, amount, threshold float64) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_unsharp_go(*img, &tmp, C.double(radius), C.double(amount), C.double(threshold)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsAdjust(img **C.struct__VipsImage, brightness, contrast, gamma float64) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_adjust_go(*img, &tmp, C.double(brightness), C.double(contrast), C.double(gamma)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsSaturation(img **C.struct__VipsImage, saturation float64) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_saturation_go(*img, &tmp, C.double(saturation)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsAutoContrast(img **C.struct__VipsImage) error {
 	var tmp *C.struct__VipsImage
 
-	if C.vips_resize_go(*img, &tmp, C.double(scale)) != 0 {
+	if C.vips_autocontrast_go(*img, &tmp) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsEqualize(img **C.struct__VipsImage, eq equalizeType) error {
+	var tmp *C.struct__VipsImage
+
+	local := C.int(0)
+	if eq == EQUALIZE_LOCAL {
+		local = 1
+	}
+
+	if C.vips_equalize_go(*img, &tmp, local) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsVignette(img **C.struct__VipsImage, strength float64, color rgbColor) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_vignette_go(*img, &tmp, C.double(strength), C.int(color.R), C.int(color.G), C.int(color.B)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsPad(img **C.struct__VipsImage, width, height, left, top int, bg paddingBackground) error {
+	var tmp *C.struct__VipsImage
+
+	blur := C.int(0)
+	if bg.Blur {
+		blur = 1
+	}
+
+	if C.vips_pad_go(*img, &tmp, C.int(width), C.int(height), C.int(left), C.int(top), blur, C.int(bg.Color.R), C.int(bg.Color.G), C.int(bg.Color.B)) != 0 {
 		return vipsError()
 	}
 
@@ -445,6 +1783,17 @@ func vipsFlip(img **C.struct__VipsImage) error {
 	return nil
 }
 
+func vipsFlipVertical(img **C.struct__VipsImage) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_flip_vertical_go(*img, &tmp) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
 func vipsCrop(img **C.struct__VipsImage, left, top, width, height int) error {
 	var tmp *C.struct__VipsImage
 
@@ -459,7 +1808,7 @@ func vipsCrop(img **C.struct__VipsImage, left, top, width, height int) error {
 func vipsSmartCrop(img **C.struct__VipsImage, width, height int) error {
 	var tmp *C.struct__VipsImage
 
-	if C.vips_smartcrop_go(*img, &tmp, C.int(width), C.int(height)) != 0 {
+	if C.vips_smartcrop_go(*img, &tmp, C.int(width), C.int(height), C.VipsInteresting(conf.SmartCropStrategy)) != 0 {
 		return vipsError()
 	}
 
@@ -467,9 +1816,37 @@ func vipsSmartCrop(img **C.struct__VipsImage, width, height int) error {
 	return nil
 }
 
-func vipsImportColourProfile(img **C.struct__VipsImage) error {
+// vipsNeedIccTransform checks if the image should be converted to sRGB using its profile.
+// CMYK images are always converted since browsers can't display them
+func vipsNeedIccTransform(img *C.struct__VipsImage, keepIcc bool) bool {
+	return C.vips_need_icc_transform(img) > 0 && (!keepIcc || C.vips_need_icc_import(img) > 0)
+}
+
+func vipsNeedColourProfileImport(img *C.struct__VipsImage, keepIcc bool) bool {
+	return vipsNeedIccTransform(img, keepIcc) || C.vips_need_icc_import(img) > 0
+}
+
+func vipsImportColourProfile(img **C.struct__VipsImage, keepIcc bool) error {
 	var tmp *C.struct__VipsImage
 
+	// Convert right to sRGB when libvips has the built-in sRGB profile
+	if vipsNeedIccTransform(*img, keepIcc) {
+		profile, err := cmykProfilePath()
+		if err != nil {
+			return err
+		}
+
+		cprofile := C.CString(profile)
+		defer C.free(unsafe.Pointer(cprofile))
+
+		if C.vips_icc_transform_go(*img, &tmp, cprofile) != 0 {
+			return vipsError()
+		}
+		C.swap_and_clear(img, tmp)
+
+		return nil
+	}
+
 	if C.vips_need_icc_import(*img) > 0 {
 		profile, err := cmykProfilePath()
 		if err != nil {
@@ -507,6 +1884,246 @@ func vipsImageCopyMemory(img **C.struct__VipsImage) error {
 	return nil
 }
 
+func vipsAddAlpha(img **C.struct__VipsImage) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_add_alpha_go(*img, &tmp) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsRemoveAlpha(img **C.struct__VipsImage) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_remove_alpha_go(*img, &tmp) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsApplyOpacity(img **C.struct__VipsImage, opacity float64) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_apply_opacity(*img, &tmp, C.double(opacity)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsApplyWatermark(img **C.struct__VipsImage, wm *watermark, opts watermarkOptions) error {
+	var tmp *C.struct__VipsImage
+
+	wmImg, err := vipsLoadImage(wm.Data, wm.Type, 1, 0)
+	if err != nil {
+		return err
+	}
+	defer C.clear_image(&wmImg)
+
+	if err = vipsFixColourspace(&wmImg); err != nil {
+		return err
+	}
+
+	if !vipsImageHasAlpha(wmImg) {
+		if err = vipsAddAlpha(&wmImg); err != nil {
+			return err
+		}
+	}
+
+	imgWidth, imgHeight := int((*img).Xsize), int((*img).Ysize)
+
+	if opts.Scale > 0 || opts.Rotate != 0 {
+		bandFormat, err := vipsPremultiply(&wmImg)
+		if err != nil {
+			return err
+		}
+
+		if opts.Scale > 0 {
+			wmScale := float64(imgWidth) * opts.Scale / float64(wmImg.Xsize)
+			if err = vipsResize(&wmImg, wmScale, wmScale, LANCZOS3); err != nil {
+				return err
+			}
+		}
+
+		if opts.Rotate != 0 {
+			if err = vipsRotateFree(&wmImg, opts.Rotate); err != nil {
+				return err
+			}
+		}
+
+		if err = vipsUnpremultiply(&wmImg, bandFormat); err != nil {
+			return err
+		}
+	}
+
+	if opts.Opacity < 1 {
+		if err = vipsApplyOpacity(&wmImg, opts.Opacity); err != nil {
+			return err
+		}
+	}
+
+	left, top := 0, 0
+
+	if opts.Tile {
+		// Offsets of the tiled watermark are the spacing between the tiles
+		if err = vipsTile(&wmImg, imgWidth, imgHeight, maxInt(opts.XOffset, 0), maxInt(opts.YOffset, 0)); err != nil {
+			return err
+		}
+	} else {
+		gravity := gravityOptions{Type: opts.Gravity, X: float64(opts.XOffset), Y: float64(opts.YOffset)}
+		left, top = calcGravityPosition(imgWidth, imgHeight, int(wmImg.Xsize), int(wmImg.Ysize), gravity)
+	}
+
+	hasAlpha := vipsImageHasAlpha(*img)
+
+	if C.vips_composite_go(*img, wmImg, &tmp, C.int(left), C.int(top), C.VipsBlendMode(opts.Blend)) != 0 {
+		return vipsError()
+	}
+	C.swap_and_clear(img, tmp)
+
+	if !hasAlpha {
+		return vipsRemoveAlpha(img)
+	}
+
+	return nil
+}
+
+// vipsRotateFree rotates the image by an arbitrary angle. The corners are transparent
+func vipsRotateFree(img **C.struct__VipsImage, angle float64) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_rotate_free_go(*img, &tmp, C.double(angle)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+// vipsFindTrim finds the bounding box of the image content, excluding the borders
+// of the background color
+func vipsFindTrim(img *C.struct__VipsImage, po processingOptions) (int, int, int, int, error) {
+	var left, top, width, height C.int
+
+	c := po.TrimColor
+
+	if C.vips_find_trim_go(img, C.double(po.TrimThreshold), cBool(!po.TrimColorSet),
+		C.int(c.R), C.int(c.G), C.int(c.B), &left, &top, &width, &height) != 0 {
+		return 0, 0, 0, 0, vipsError()
+	}
+
+	return int(left), int(top), int(width), int(height), nil
+}
+
+func vipsDrawText(img **C.struct__VipsImage, text, font string, size int, color rgbColor, gravity gravityType, padding int) error {
+	var tmp, textImg *C.struct__VipsImage
+
+	ctext := C.CString(text)
+	defer C.free(unsafe.Pointer(ctext))
+
+	cfont := C.CString(fmt.Sprintf("%s %d", font, size))
+	defer C.free(unsafe.Pointer(cfont))
+
+	imgWidth, imgHeight := int((*img).Xsize), int((*img).Ysize)
+
+	// Long texts are wrapped to fit the image
+	width := maxInt(imgWidth-padding*2, 1)
+
+	if C.vips_text_go(&textImg, ctext, cfont, C.int(width), C.int(color.R), C.int(color.G), C.int(color.B)) != 0 {
+		return vipsError()
+	}
+	defer C.clear_image(&textImg)
+
+	left, top := calcGravityPosition(imgWidth, imgHeight, int(textImg.Xsize), int(textImg.Ysize),
+		gravityOptions{Type: gravity, X: float64(padding), Y: float64(padding)})
+
+	hasAlpha := vipsImageHasAlpha(*img)
+
+	if C.vips_composite_go(*img, textImg, &tmp, C.int(left), C.int(top), C.VIPS_BLEND_MODE_OVER) != 0 {
+		return vipsError()
+	}
+	C.swap_and_clear(img, tmp)
+
+	if !hasAlpha {
+		return vipsRemoveAlpha(img)
+	}
+
+	return nil
+}
+
+// vipsRotateFill rotates the image by an arbitrary angle and fills the corners with the color
+func vipsRotateFill(img **C.struct__VipsImage, angle float64, fill bool, bg rgbColor) error {
+	if !fill {
+		return vipsRotateFree(img, angle)
+	}
+
+	var tmp *C.struct__VipsImage
+
+	if C.vips_rotate_fill_go(*img, &tmp, C.double(angle), C.int(bg.R), C.int(bg.G), C.int(bg.B)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+// vipsTile repeats the image to cover the given area
+func vipsTile(img **C.struct__VipsImage, width, height, spacingX, spacingY int) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_tile_go(*img, &tmp, C.int(width), C.int(height), C.int(spacingX), C.int(spacingY)) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+// vipsCopy makes a shallow copy of the image so its metadata can be changed safely
+func vipsCopy(img **C.struct__VipsImage) error {
+	var tmp *C.struct__VipsImage
+
+	if C.vips_copy_go(*img, &tmp) != 0 {
+		return vipsError()
+	}
+
+	C.swap_and_clear(img, tmp)
+	return nil
+}
+
+func vipsResetOrientation(img **C.struct__VipsImage) error {
+	if err := vipsCopy(img); err != nil {
+		return err
+	}
+
+	C.vips_reset_orientation(*img)
+	return nil
+}
+
+func vipsRemoveSensitiveMetadata(img **C.struct__VipsImage) error {
+	if err := vipsCopy(img); err != nil {
+		return err
+	}
+
+	C.vips_remove_sensitive_metadata(*img)
+	return nil
+}
+
+func vipsStripMetadata(img **C.struct__VipsImage, keepCopyright, keepIcc bool) error {
+	if err := vipsCopy(img); err != nil {
+		return err
+	}
+
+	C.vips_strip_metadata_go(*img, cBool(keepCopyright), cBool(keepIcc))
+	return nil
+}
+
 func vipsError() error {
 	return errors.New(C.GoString(C.vips_error_buffer()))
 }
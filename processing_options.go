@@ -0,0 +1,1883 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func newProcessingOptions() processingOptions {
+	po := processingOptions{
+		Resize:            FIT,
+		Gravity:           gravityOptions{Type: CENTER},
+		Format:            JPEG,
+		Quality:           conf.Quality,
+		Autoquality:       conf.AutoqualityMethod,
+		AutoqualityTarget: conf.AutoqualityTarget,
+		Metadata:          conf.MetadataPolicy,
+		KeepCopyright:     conf.KeepCopyright,
+		KeepIcc:           conf.KeepIcc,
+		ReturnAttachment:  conf.ReturnAttachment,
+		TTL:               conf.TTL,
+		Kernel:            conf.ResamplingKernel,
+		PaletteColors:     conf.PNGPaletteColors,
+		Dither:            conf.PNGDither,
+		JpegProgressive:   conf.JpegProgressive,
+		JpegNoSubsample:   conf.JpegNoSubsample,
+		PngInterlaced:     conf.PngInterlaced,
+		WebpLossless:      conf.WebpLossless,
+		Timeout:           conf.WriteTimeout,
+		MaxSrcDimension:   conf.MaxSrcDimension,
+		MaxSrcResolution:  conf.MaxSrcResolution,
+		Dpr:               1,
+		Saturation:        1,
+		Contrast:          1,
+		Background:        conf.Background,
+		Gamma:             1,
+		TextFont:          conf.TextFont,
+		TextSize:          24,
+		TextPadding:       10,
+	}
+
+	// The default preset is applied to all the requests. It's validated on start
+	if _, ok := presets["default"]; ok {
+		applyPreset(&po, "default")
+	}
+
+	return po
+}
+
+const maxDpr = 8
+
+const maxTextSize = 1000
+
+const maxLayers = 10
+
+// pipelineSeparator is the path segment that separates the pipelines
+const pipelineSeparator = "-"
+
+const maxPipelines = 10
+
+type rgbColor struct{ R, G, B uint8 }
+
+func parseHexColor(str string) (rgbColor, error) {
+	c := rgbColor{}
+
+	if len(str) != 6 {
+		return c, fmt.Errorf("Invalid color: %s", str)
+	}
+
+	b, err := hex.DecodeString(str)
+	if err != nil {
+		return c, fmt.Errorf("Invalid color: %s", str)
+	}
+
+	c.R, c.G, c.B = b[0], b[1], b[2]
+
+	return c, nil
+}
+
+// paddingBackground is either a solid color or a blurred copy of the image itself
+type paddingBackground struct {
+	Blur  bool
+	Color rgbColor
+}
+
+func parsePaddingBackground(str string) (paddingBackground, error) {
+	if str == "blur" {
+		return paddingBackground{Blur: true}, nil
+	}
+
+	c, err := parseHexColor(str)
+	if err != nil {
+		return paddingBackground{}, fmt.Errorf("Invalid padding background: %s", str)
+	}
+
+	return paddingBackground{Color: c}, nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func applyTimeoutOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid timeout arguments: %v", args)
+	}
+
+	max := maxInt(conf.WriteTimeout, conf.MaxTimeoutOverride)
+
+	if t, err := strconv.Atoi(args[0]); err == nil && t > 0 && t <= max {
+		po.Timeout = t
+	} else {
+		return fmt.Errorf("Invalid timeout: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyTTLOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid TTL arguments: %v", args)
+	}
+
+	if ttl, err := strconv.Atoi(args[0]); err == nil && ttl >= 0 {
+		po.TTL = ttl
+		po.TTLSet = true
+	} else {
+		return fmt.Errorf("Invalid TTL: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyQualityOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid quality arguments: %v", args)
+	}
+
+	max := maxInt(conf.Quality, conf.MaxQualityOverride)
+
+	if q, err := strconv.Atoi(args[0]); err == nil && q > 0 && q <= max {
+		po.Quality = q
+		po.QualitySet = true
+	} else {
+		return fmt.Errorf("Invalid quality: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyMaxBytesOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("Invalid max bytes arguments: %v", args)
+	}
+
+	if b, err := strconv.Atoi(args[0]); err == nil && b >= 0 {
+		po.MaxBytes = b
+	} else {
+		return fmt.Errorf("Invalid max bytes: %s", args[0])
+	}
+
+	po.MaxBytesResize = false
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		if r, err := strconv.ParseBool(args[1]); err == nil {
+			po.MaxBytesResize = r
+		} else {
+			return fmt.Errorf("Invalid max bytes resize: %s", args[1])
+		}
+	}
+
+	return nil
+}
+
+func applyAutoqualityOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("Invalid autoquality arguments: %v", args)
+	}
+
+	if m, ok := autoqualityMethods[args[0]]; ok {
+		po.Autoquality = m
+	} else {
+		return fmt.Errorf("Invalid autoquality method: %s", args[0])
+	}
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		if t, err := strconv.ParseFloat(args[1], 64); err == nil && t > 0 {
+			po.AutoqualityTarget = t
+		} else {
+			return fmt.Errorf("Invalid autoquality target: %s", args[1])
+		}
+	}
+
+	return nil
+}
+
+func applyMaxSrcDimensionOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid max src dimension arguments: %v", args)
+	}
+
+	max := maxInt(conf.MaxSrcDimension, conf.MaxSrcDimensionOverride)
+
+	if d, err := strconv.Atoi(args[0]); err == nil && d > 0 && d <= max {
+		po.MaxSrcDimension = d
+	} else {
+		return fmt.Errorf("Invalid max src dimension: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyMaxSrcResolutionOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid max src resolution arguments: %v", args)
+	}
+
+	max := maxInt(conf.MaxSrcResolution, conf.MaxSrcResolutionOverride)
+
+	if r, err := strconv.ParseFloat(args[0], 64); err == nil && r > 0 && int(r*1000000) <= max {
+		po.MaxSrcResolution = int(r * 1000000)
+	} else {
+		return fmt.Errorf("Invalid max src resolution: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyMetadataOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid metadata arguments: %v", args)
+	}
+
+	if p, ok := metadataPolicies[args[0]]; ok {
+		po.Metadata = p
+	} else {
+		return fmt.Errorf("Invalid metadata policy: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyWatermarkURLOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid watermark URL arguments: %v", args)
+	}
+
+	u, err := base64.RawURLEncoding.DecodeString(args[0])
+	if err != nil {
+		return fmt.Errorf("Invalid watermark URL encoding: %s", args[0])
+	}
+
+	if _, err = url.ParseRequestURI(string(u)); err != nil {
+		return fmt.Errorf("Invalid watermark URL: %s", u)
+	}
+
+	// The URL watermark replaces the named one but keeps the current options
+	if len(po.Watermark.Name) == 0 && len(po.Watermark.URL) == 0 {
+		po.Watermark = newWatermarkOptions()
+	}
+	po.Watermark.Name = ""
+	po.Watermark.URL = string(u)
+
+	return nil
+}
+
+func applyLayerOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 7 {
+		return fmt.Errorf("Invalid layer arguments: %v", args)
+	}
+
+	if len(po.Layers) >= maxLayers {
+		return fmt.Errorf("Too many layers, the maximum is %d", maxLayers)
+	}
+
+	u, err := base64.RawURLEncoding.DecodeString(args[0])
+	if err != nil {
+		return fmt.Errorf("Invalid layer URL encoding: %s", args[0])
+	}
+
+	if _, err = url.ParseRequestURI(string(u)); err != nil {
+		return fmt.Errorf("Invalid layer URL: %s", u)
+	}
+
+	layer := newWatermarkOptions()
+	layer.URL = string(u)
+	layer.Gravity = CENTER
+
+	// Empty arguments keep the defaults
+	if len(args) > 1 && len(args[1]) > 0 {
+		if g, ok := gravityTypes[args[1]]; ok && g != SMART {
+			layer.Gravity = g
+		} else {
+			return fmt.Errorf("Invalid layer position: %s", args[1])
+		}
+	}
+
+	if len(args) > 2 && len(args[2]) > 0 {
+		if x, err := strconv.Atoi(args[2]); err == nil {
+			layer.XOffset = x
+		} else {
+			return fmt.Errorf("Invalid layer x offset: %s", args[2])
+		}
+	}
+
+	if len(args) > 3 && len(args[3]) > 0 {
+		if y, err := strconv.Atoi(args[3]); err == nil {
+			layer.YOffset = y
+		} else {
+			return fmt.Errorf("Invalid layer y offset: %s", args[3])
+		}
+	}
+
+	if len(args) > 4 && len(args[4]) > 0 {
+		if sc, err := strconv.ParseFloat(args[4], 64); err == nil && sc >= 0 && sc <= 1 {
+			layer.Scale = sc
+		} else {
+			return fmt.Errorf("Invalid layer scale: %s", args[4])
+		}
+	}
+
+	if len(args) > 5 && len(args[5]) > 0 {
+		if b, ok := blendModes[args[5]]; ok {
+			layer.Blend = b
+		} else {
+			return fmt.Errorf("Invalid layer blend mode: %s", args[5])
+		}
+	}
+
+	if len(args) > 6 && len(args[6]) > 0 {
+		if o, err := strconv.ParseFloat(args[6], 64); err == nil && o >= 0 && o <= 1 {
+			layer.Opacity = o
+		} else {
+			return fmt.Errorf("Invalid layer opacity: %s", args[6])
+		}
+	}
+
+	po.Layers = append(po.Layers, layer)
+
+	return nil
+}
+
+// applyStripMetadataOption is a boolean shortcut for the strip and keep metadata policies
+func applyStripMetadataOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid strip metadata arguments: %v", args)
+	}
+
+	if b, err := strconv.ParseBool(args[0]); err == nil {
+		if b {
+			po.Metadata = METADATA_STRIP
+		} else {
+			po.Metadata = METADATA_KEEP
+		}
+	} else {
+		return fmt.Errorf("Invalid strip metadata: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyKeepCopyrightOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid keep copyright arguments: %v", args)
+	}
+
+	if b, err := strconv.ParseBool(args[0]); err == nil {
+		po.KeepCopyright = b
+	} else {
+		return fmt.Errorf("Invalid keep copyright: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyKeepIccOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid keep ICC arguments: %v", args)
+	}
+
+	if b, err := strconv.ParseBool(args[0]); err == nil {
+		po.KeepIcc = b
+	} else {
+		return fmt.Errorf("Invalid keep ICC: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyWatermarkOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 7 {
+		return fmt.Errorf("Invalid watermark arguments: %v", args)
+	}
+
+	// Empty name keeps the current watermark, e.g. the one set by the watermark URL
+	if len(args[0]) == 0 {
+		if len(po.Watermark.Name) == 0 && len(po.Watermark.URL) == 0 {
+			return errors.New("Watermark name is required")
+		}
+	} else if wm, ok := watermarks[args[0]]; ok {
+		po.Watermark = wm.Defaults
+	} else {
+		return fmt.Errorf("Unknown watermark: %s", args[0])
+	}
+
+	// Empty arguments keep the watermark defaults
+	if len(args) > 1 && len(args[1]) > 0 {
+		if o, err := strconv.ParseFloat(args[1], 64); err == nil && o >= 0 && o <= 1 {
+			po.Watermark.Opacity = o
+		} else {
+			return fmt.Errorf("Invalid watermark opacity: %s", args[1])
+		}
+	}
+
+	if len(args) > 2 && len(args[2]) > 0 {
+		g, tile, err := parseWatermarkPosition(args[2])
+		if err != nil {
+			return err
+		}
+		po.Watermark.Gravity, po.Watermark.Tile = g, tile
+	}
+
+	if len(args) > 3 && len(args[3]) > 0 {
+		if sc, err := strconv.ParseFloat(args[3], 64); err == nil && sc >= 0 && sc <= 1 {
+			po.Watermark.Scale = sc
+		} else {
+			return fmt.Errorf("Invalid watermark scale: %s", args[3])
+		}
+	}
+
+	if len(args) > 4 && len(args[4]) > 0 {
+		if r, err := strconv.ParseFloat(args[4], 64); err == nil {
+			po.Watermark.Rotate = r
+		} else {
+			return fmt.Errorf("Invalid watermark rotation: %s", args[4])
+		}
+	}
+
+	if len(args) > 5 && len(args[5]) > 0 {
+		if x, err := strconv.Atoi(args[5]); err == nil {
+			po.Watermark.XOffset = x
+		} else {
+			return fmt.Errorf("Invalid watermark x offset: %s", args[5])
+		}
+	}
+
+	if len(args) > 6 && len(args[6]) > 0 {
+		if y, err := strconv.Atoi(args[6]); err == nil {
+			po.Watermark.YOffset = y
+		} else {
+			return fmt.Errorf("Invalid watermark y offset: %s", args[6])
+		}
+	}
+
+	return nil
+}
+
+func applyVariantOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid variant arguments: %v", args)
+	}
+
+	if _, ok := variantGroups[args[0]]; ok {
+		po.VariantGroup = args[0]
+	} else {
+		return fmt.Errorf("Unknown variant group: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyFilenameOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("Invalid filename arguments: %v", args)
+	}
+
+	filename := args[0]
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		encoded, err := strconv.ParseBool(args[1])
+		if err != nil {
+			return fmt.Errorf("Invalid filename encoding: %s", args[1])
+		}
+
+		if encoded {
+			b, err := base64.RawURLEncoding.DecodeString(filename)
+			if err != nil {
+				return fmt.Errorf("Invalid filename encoding: %s", filename)
+			}
+			filename = string(b)
+		}
+	}
+
+	po.Filename = filename
+
+	return nil
+}
+
+func applyReturnAttachmentOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid return attachment arguments: %v", args)
+	}
+
+	if b, err := strconv.ParseBool(args[0]); err == nil {
+		po.ReturnAttachment = b
+	} else {
+		return fmt.Errorf("Invalid return attachment: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyCacheBusterOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid cache buster arguments: %v", args)
+	}
+
+	po.CacheBuster = args[0]
+
+	return nil
+}
+
+func applyPageOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid page arguments: %v", args)
+	}
+
+	if p, err := strconv.Atoi(args[0]); err == nil && p >= 0 {
+		po.Page = p
+	} else {
+		return fmt.Errorf("Invalid page: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyDPIOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid dpi arguments: %v", args)
+	}
+
+	if d, err := strconv.ParseFloat(args[0], 64); err == nil && d > 0 {
+		po.DPI = d
+	} else {
+		return fmt.Errorf("Invalid dpi: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyVideoSecondOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid video thumbnail second arguments: %v", args)
+	}
+
+	if s, err := strconv.ParseFloat(args[0], 64); err == nil && s >= 0 {
+		po.VideoSecond = s
+	} else {
+		return fmt.Errorf("Invalid video thumbnail second: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyDprOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid dpr arguments: %v", args)
+	}
+
+	if d, err := strconv.ParseFloat(args[0], 64); err == nil && d > 0 && d <= maxDpr {
+		po.Dpr = d
+	} else {
+		return fmt.Errorf("Invalid dpr: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyKernelOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid kernel arguments: %v", args)
+	}
+
+	if k, ok := resamplingKernels[args[0]]; ok {
+		po.Kernel = k
+	} else {
+		return fmt.Errorf("Invalid kernel: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyPaletteOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid palette arguments: %v", args)
+	}
+
+	if c, err := strconv.Atoi(args[0]); err == nil && (c == 0 || (c >= 2 && c <= 256)) {
+		po.PaletteColors = c
+	} else {
+		return fmt.Errorf("Invalid palette colors: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyDitherOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("Invalid dither arguments: %v", args)
+	}
+
+	switch args[0] {
+	case "none":
+		if len(args) > 1 {
+			return fmt.Errorf("Invalid dither arguments: %v", args)
+		}
+		po.Dither = 0
+	case "fs":
+		po.Dither = 1
+		if len(args) > 1 {
+			if d, err := strconv.ParseFloat(args[1], 64); err == nil && d >= 0 && d <= 1 {
+				po.Dither = d
+			} else {
+				return fmt.Errorf("Invalid dither strength: %s", args[1])
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid dither method: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyJpegOptionsOption(po *processingOptions, args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("Invalid jpeg options arguments: %v", args)
+	}
+
+	if len(args[0]) > 0 {
+		if b, err := strconv.ParseBool(args[0]); err == nil {
+			po.JpegProgressive = b
+		} else {
+			return fmt.Errorf("Invalid jpeg progressive: %s", args[0])
+		}
+	}
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		if b, err := strconv.ParseBool(args[1]); err == nil {
+			po.JpegNoSubsample = b
+		} else {
+			return fmt.Errorf("Invalid jpeg no subsample: %s", args[1])
+		}
+	}
+
+	return nil
+}
+
+func applyPngOptionsOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid png options arguments: %v", args)
+	}
+
+	if len(args[0]) > 0 {
+		if b, err := strconv.ParseBool(args[0]); err == nil {
+			po.PngInterlaced = b
+		} else {
+			return fmt.Errorf("Invalid png interlaced: %s", args[0])
+		}
+	}
+
+	return nil
+}
+
+func applyWebpOptionsOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid webp options arguments: %v", args)
+	}
+
+	if len(args[0]) > 0 {
+		if b, err := strconv.ParseBool(args[0]); err == nil {
+			po.WebpLossless = b
+		} else {
+			return fmt.Errorf("Invalid webp lossless: %s", args[0])
+		}
+	}
+
+	return nil
+}
+
+func applyDenoiseOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid denoise arguments: %v", args)
+	}
+
+	if d, err := strconv.Atoi(args[0]); err == nil && d >= 0 && d <= 5 {
+		po.Denoise = d
+	} else {
+		return fmt.Errorf("Invalid denoise strength: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyRotateOption(po *processingOptions, args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("Invalid rotate arguments: %v", args)
+	}
+
+	if r, err := strconv.ParseFloat(args[0], 64); err == nil {
+		// Normalize the angle to [0, 360)
+		r = math.Mod(r, 360)
+		if r < 0 {
+			r += 360
+		}
+		po.Rotate = r
+	} else {
+		return fmt.Errorf("Invalid rotation angle: %s", args[0])
+	}
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		c, err := parseHexColor(args[1])
+		if err != nil {
+			return fmt.Errorf("Invalid rotation background: %s", args[1])
+		}
+		po.RotateBackground = c
+		po.RotateFill = true
+	}
+
+	return nil
+}
+
+func applyFlipOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid flip arguments: %v", args)
+	}
+
+	if b, err := strconv.ParseBool(args[0]); err == nil {
+		po.Flip = b
+	} else {
+		return fmt.Errorf("Invalid flip: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyFlopOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid flop arguments: %v", args)
+	}
+
+	if b, err := strconv.ParseBool(args[0]); err == nil {
+		po.Flop = b
+	} else {
+		return fmt.Errorf("Invalid flop: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyBackgroundOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid background arguments: %v", args)
+	}
+
+	// An empty background disables flattening
+	if len(args[0]) == 0 {
+		po.Flatten = false
+		return nil
+	}
+
+	c, err := parseHexColor(args[0])
+	if err != nil {
+		return fmt.Errorf("Invalid background: %s", args[0])
+	}
+
+	po.Background = c
+	po.Flatten = true
+
+	return nil
+}
+
+func applyTrimOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("Invalid trim arguments: %v", args)
+	}
+
+	// Zero threshold disables trimming so it can be overridden in presets
+	if t, err := strconv.ParseFloat(args[0], 64); err == nil && t >= 0 {
+		po.Trim = t > 0
+		po.TrimThreshold = t
+	} else {
+		return fmt.Errorf("Invalid trim threshold: %s", args[0])
+	}
+
+	po.TrimColorSet = false
+
+	if len(args) == 2 && len(args[1]) > 0 {
+		c, err := parseHexColor(args[1])
+		if err != nil {
+			return fmt.Errorf("Invalid trim color: %s", args[1])
+		}
+
+		po.TrimColor = c
+		po.TrimColorSet = true
+	}
+
+	return nil
+}
+
+func applyCropOption(po *processingOptions, args []string) error {
+	if len(args) < 2 || len(args) > 5 {
+		return fmt.Errorf("Invalid crop arguments: %v", args)
+	}
+
+	if w, err := strconv.Atoi(args[0]); err == nil && w >= 0 {
+		po.CropWidth = w
+	} else {
+		return fmt.Errorf("Invalid crop width: %s", args[0])
+	}
+
+	if h, err := strconv.Atoi(args[1]); err == nil && h >= 0 {
+		po.CropHeight = h
+	} else {
+		return fmt.Errorf("Invalid crop height: %s", args[1])
+	}
+
+	po.CropGravity = gravityOptions{Type: CENTER}
+	po.CropOffset = false
+
+	switch {
+	case len(args) == 2:
+	case len(args) == 4 && !isGravityName(args[2]):
+		x, err := strconv.Atoi(args[2])
+		if err != nil || x < 0 {
+			return fmt.Errorf("Invalid crop x: %s", args[2])
+		}
+
+		y, err := strconv.Atoi(args[3])
+		if err != nil || y < 0 {
+			return fmt.Errorf("Invalid crop y: %s", args[3])
+		}
+
+		po.CropX, po.CropY = x, y
+		po.CropOffset = true
+	default:
+		g, err := parseGravity(args[2:])
+		if err != nil {
+			return fmt.Errorf("Invalid crop gravity: %s", strings.Join(args[2:], ":"))
+		}
+		po.CropGravity = g
+	}
+
+	return nil
+}
+
+func applyBlurOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid blur arguments: %v", args)
+	}
+
+	if b, err := strconv.ParseFloat(args[0], 64); err == nil && b >= 0 {
+		po.Blur = b
+	} else {
+		return fmt.Errorf("Invalid blur sigma: %s", args[0])
+	}
+
+	return nil
+}
+
+func applySaturationOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid saturation arguments: %v", args)
+	}
+
+	if s, err := strconv.ParseFloat(args[0], 64); err == nil && s >= 0 {
+		po.Saturation = s
+	} else {
+		return fmt.Errorf("Invalid saturation: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyBrightnessOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid brightness arguments: %v", args)
+	}
+
+	if b, err := strconv.ParseFloat(args[0], 64); err == nil && b >= -255 && b <= 255 {
+		po.Brightness = b
+	} else {
+		return fmt.Errorf("Invalid brightness: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyContrastOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid contrast arguments: %v", args)
+	}
+
+	if c, err := strconv.ParseFloat(args[0], 64); err == nil && c >= 0 {
+		po.Contrast = c
+	} else {
+		return fmt.Errorf("Invalid contrast: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyGammaOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid gamma arguments: %v", args)
+	}
+
+	if g, err := strconv.ParseFloat(args[0], 64); err == nil && g > 0 {
+		po.Gamma = g
+	} else {
+		return fmt.Errorf("Invalid gamma: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyAutoContrastOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid autocontrast arguments: %v", args)
+	}
+
+	if b, err := strconv.ParseBool(args[0]); err == nil {
+		po.AutoContrast = b
+	} else {
+		return fmt.Errorf("Invalid autocontrast: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyEqualizeOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid equalize arguments: %v", args)
+	}
+
+	if e, ok := equalizeTypes[args[0]]; ok {
+		po.Equalize = e
+	} else {
+		return fmt.Errorf("Invalid equalize type: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyVignetteOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("Invalid vignette arguments: %v", args)
+	}
+
+	if v, err := strconv.ParseFloat(args[0], 64); err == nil && v >= 0 && v <= 1 {
+		po.Vignette = v
+	} else {
+		return fmt.Errorf("Invalid vignette strength: %s", args[0])
+	}
+
+	if len(args) > 1 {
+		c, err := parseHexColor(args[1])
+		if err != nil {
+			return err
+		}
+		po.VignetteColor = c
+	}
+
+	return nil
+}
+
+func applyAspectRatioOption(po *processingOptions, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Invalid aspect ratio arguments: %v", args)
+	}
+
+	w, werr := strconv.ParseFloat(args[0], 64)
+	h, herr := strconv.ParseFloat(args[1], 64)
+
+	if werr != nil || herr != nil || w < 0 || h <= 0 {
+		return fmt.Errorf("Invalid aspect ratio: %s:%s", args[0], args[1])
+	}
+
+	po.AspectRatio = w / h
+
+	return nil
+}
+
+func applyExtendAspectRatioOption(po *processingOptions, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return fmt.Errorf("Invalid extend aspect ratio arguments: %v", args)
+	}
+
+	w, werr := strconv.ParseFloat(args[0], 64)
+	h, herr := strconv.ParseFloat(args[1], 64)
+
+	if werr != nil || herr != nil || w < 0 || h <= 0 {
+		return fmt.Errorf("Invalid extend aspect ratio: %s:%s", args[0], args[1])
+	}
+
+	po.ExtendAspectRatio = w / h
+
+	if len(args) > 2 {
+		bg, err := parsePaddingBackground(args[2])
+		if err != nil {
+			return err
+		}
+		po.PadBackground = bg
+	}
+
+	return nil
+}
+
+func applyExtendOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return fmt.Errorf("Invalid extend arguments: %v", args)
+	}
+
+	if b, err := strconv.ParseBool(args[0]); err == nil {
+		po.Extend = b
+	} else {
+		return fmt.Errorf("Invalid extend: %s", args[0])
+	}
+
+	po.ExtendGravity = CENTER
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		if g, ok := gravityTypes[args[1]]; ok && g != SMART {
+			po.ExtendGravity = g
+		} else {
+			return fmt.Errorf("Invalid extend gravity: %s", args[1])
+		}
+	}
+
+	if len(args) > 2 {
+		bg, err := parsePaddingBackground(args[2])
+		if err != nil {
+			return err
+		}
+		po.PadBackground = bg
+	}
+
+	return nil
+}
+
+func applyTextOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 6 {
+		return fmt.Errorf("Invalid text arguments: %v", args)
+	}
+
+	text, err := base64.RawURLEncoding.DecodeString(args[0])
+	if err != nil {
+		return fmt.Errorf("Invalid text encoding: %s", args[0])
+	}
+	po.Text = string(text)
+
+	// Empty arguments keep the defaults
+	if len(args) > 1 && len(args[1]) > 0 {
+		if s, err := strconv.Atoi(args[1]); err == nil && s > 0 && s <= maxTextSize {
+			po.TextSize = s
+		} else {
+			return fmt.Errorf("Invalid text size: %s", args[1])
+		}
+	}
+
+	if len(args) > 2 && len(args[2]) > 0 {
+		c, err := parseHexColor(args[2])
+		if err != nil {
+			return fmt.Errorf("Invalid text color: %s", args[2])
+		}
+		po.TextColor = c
+	}
+
+	if len(args) > 3 && len(args[3]) > 0 {
+		if g, ok := gravityTypes[args[3]]; ok && g != SMART {
+			po.TextGravity = g
+		} else {
+			return fmt.Errorf("Invalid text position: %s", args[3])
+		}
+	}
+
+	if len(args) > 4 && len(args[4]) > 0 {
+		if p, err := strconv.Atoi(args[4]); err == nil && p >= 0 {
+			po.TextPadding = p
+		} else {
+			return fmt.Errorf("Invalid text padding: %s", args[4])
+		}
+	}
+
+	if len(args) > 5 && len(args[5]) > 0 {
+		po.TextFont = args[5]
+	}
+
+	return nil
+}
+
+func applyBorderOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("Invalid border arguments: %v", args)
+	}
+
+	if w, err := strconv.Atoi(args[0]); err == nil && w >= 0 {
+		po.BorderWidth = w
+	} else {
+		return fmt.Errorf("Invalid border width: %s", args[0])
+	}
+
+	po.BorderColor = rgbColor{}
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		c, err := parseHexColor(args[1])
+		if err != nil {
+			return fmt.Errorf("Invalid border color: %s", args[1])
+		}
+		po.BorderColor = c
+	}
+
+	return nil
+}
+
+func applyRoundedCornersOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("Invalid rounded corners arguments: %v", args)
+	}
+
+	po.CornerRadius = 0
+	po.Circle = false
+
+	if args[0] == "circle" {
+		po.Circle = true
+	} else if r, err := strconv.Atoi(args[0]); err == nil && r >= 0 {
+		po.CornerRadius = r
+	} else {
+		return fmt.Errorf("Invalid rounded corners radius: %s", args[0])
+	}
+
+	po.CornersFill = false
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		c, err := parseHexColor(args[1])
+		if err != nil {
+			return fmt.Errorf("Invalid rounded corners background: %s", args[1])
+		}
+
+		po.CornersBackground = c
+		po.CornersFill = true
+	}
+
+	return nil
+}
+
+func applyPadBackgroundOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid padding background arguments: %v", args)
+	}
+
+	bg, err := parsePaddingBackground(args[0])
+	if err != nil {
+		return err
+	}
+	po.PadBackground = bg
+
+	return nil
+}
+
+func applyResizingTypeOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid resizing type arguments: %v", args)
+	}
+
+	if r, ok := resizeTypes[args[0]]; ok {
+		po.Resize = r
+	} else {
+		return fmt.Errorf("Invalid resize type: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyWidthOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid width arguments: %v", args)
+	}
+
+	if w, err := strconv.Atoi(args[0]); err == nil && w >= 0 {
+		po.Width = w
+	} else {
+		return fmt.Errorf("Invalid width: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyMinWidthOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid min width arguments: %v", args)
+	}
+
+	if w, err := strconv.Atoi(args[0]); err == nil && w >= 0 {
+		po.MinWidth = w
+	} else {
+		return fmt.Errorf("Invalid min width: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyMinHeightOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid min height arguments: %v", args)
+	}
+
+	if h, err := strconv.Atoi(args[0]); err == nil && h >= 0 {
+		po.MinHeight = h
+	} else {
+		return fmt.Errorf("Invalid min height: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyHeightOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid height arguments: %v", args)
+	}
+
+	if h, err := strconv.Atoi(args[0]); err == nil && h >= 0 {
+		po.Height = h
+	} else {
+		return fmt.Errorf("Invalid height: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyEnlargeOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid enlarge arguments: %v", args)
+	}
+
+	po.Enlarge = args[0] != "0"
+
+	return nil
+}
+
+// applySizeOption parses %width:%height:%enlarge; empty and missing arguments are kept as is
+func applySizeOption(po *processingOptions, args []string) error {
+	if len(args) > 3 {
+		return fmt.Errorf("Invalid size arguments: %v", args)
+	}
+
+	if len(args) > 0 && len(args[0]) > 0 {
+		if err := applyWidthOption(po, args[0:1]); err != nil {
+			return err
+		}
+	}
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		if err := applyHeightOption(po, args[1:2]); err != nil {
+			return err
+		}
+	}
+
+	if len(args) > 2 && len(args[2]) > 0 {
+		if err := applyEnlargeOption(po, args[2:3]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyResizeOption(po *processingOptions, args []string) error {
+	if len(args) < 1 || len(args) > 4 {
+		return fmt.Errorf("Invalid resize arguments: %v", args)
+	}
+
+	if len(args[0]) > 0 {
+		if err := applyResizingTypeOption(po, args[0:1]); err != nil {
+			return err
+		}
+	}
+
+	return applySizeOption(po, args[1:])
+}
+
+func isGravityName(str string) bool {
+	if str == "fp" {
+		return true
+	}
+	_, ok := gravityTypes[str]
+	return ok
+}
+
+func parseGravity(args []string) (gravityOptions, error) {
+	g := gravityOptions{}
+
+	if args[0] == "fp" {
+		if len(args) != 3 {
+			return g, fmt.Errorf("Invalid focus point gravity arguments: %v", args)
+		}
+
+		x, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || x < 0 || x > 1 {
+			return g, fmt.Errorf("Invalid focus point x: %s", args[1])
+		}
+
+		y, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || y < 0 || y > 1 {
+			return g, fmt.Errorf("Invalid focus point y: %s", args[2])
+		}
+
+		g.Type, g.X, g.Y = FOCUS_POINT, x, y
+		return g, nil
+	}
+
+	if len(args) != 1 && len(args) != 3 {
+		return g, fmt.Errorf("Invalid gravity arguments: %v", args)
+	}
+
+	if t, ok := gravityTypes[args[0]]; ok {
+		g.Type = t
+	} else {
+		return g, fmt.Errorf("Invalid gravity: %s", args[0])
+	}
+
+	if len(args) == 3 {
+		if g.Type == SMART {
+			return g, errors.New("Smart gravity doesn't support offsets")
+		}
+
+		x, err := strconv.Atoi(args[1])
+		if err != nil {
+			return g, fmt.Errorf("Invalid gravity x offset: %s", args[1])
+		}
+
+		y, err := strconv.Atoi(args[2])
+		if err != nil {
+			return g, fmt.Errorf("Invalid gravity y offset: %s", args[2])
+		}
+
+		g.X, g.Y = float64(x), float64(y)
+	}
+
+	return g, nil
+}
+
+func applyGravityOption(po *processingOptions, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Invalid gravity arguments: %v", args)
+	}
+
+	g, err := parseGravity(args)
+	if err != nil {
+		return err
+	}
+	po.Gravity = g
+
+	return nil
+}
+
+func applyFormatOption(po *processingOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Invalid format arguments: %v", args)
+	}
+
+	if f, ok := imageTypes[args[0]]; ok {
+		po.Format = f
+		po.FormatSet = true
+	} else {
+		return fmt.Errorf("Invalid image format: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyPresetOption(po *processingOptions, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Invalid preset arguments: %v", args)
+	}
+
+	for _, name := range args {
+		if err := applyPreset(po, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyProcessingOption(po *processingOptions, name string, args []string) error {
+	switch name {
+	case "preset", "pr":
+		return applyPresetOption(po, args)
+	case "resize", "rs":
+		return applyResizeOption(po, args)
+	case "size", "s":
+		return applySizeOption(po, args)
+	case "resizing_type", "rt":
+		return applyResizingTypeOption(po, args)
+	case "width", "w":
+		return applyWidthOption(po, args)
+	case "height", "h":
+		return applyHeightOption(po, args)
+	case "min_width", "mw":
+		return applyMinWidthOption(po, args)
+	case "min_height", "mh":
+		return applyMinHeightOption(po, args)
+	case "enlarge", "el":
+		return applyEnlargeOption(po, args)
+	case "gravity", "g":
+		return applyGravityOption(po, args)
+	case "format", "f", "ext":
+		return applyFormatOption(po, args)
+	case "timeout":
+		return applyTimeoutOption(po, args)
+	case "ttl":
+		return applyTTLOption(po, args)
+	case "quality", "q":
+		return applyQualityOption(po, args)
+	case "max_src_dimension":
+		return applyMaxSrcDimensionOption(po, args)
+	case "max_src_resolution":
+		return applyMaxSrcResolutionOption(po, args)
+	case "metadata":
+		return applyMetadataOption(po, args)
+	case "strip_metadata", "sm":
+		return applyStripMetadataOption(po, args)
+	case "keep_copyright", "kcr":
+		return applyKeepCopyrightOption(po, args)
+	case "keep_icc", "ki":
+		return applyKeepIccOption(po, args)
+	case "wm", "watermark":
+		return applyWatermarkOption(po, args)
+	case "max_bytes", "mb":
+		return applyMaxBytesOption(po, args)
+	case "autoquality", "aq":
+		return applyAutoqualityOption(po, args)
+	case "wmu", "watermark_url":
+		return applyWatermarkURLOption(po, args)
+	case "layer", "ly":
+		return applyLayerOption(po, args)
+	case "variant":
+		return applyVariantOption(po, args)
+	case "filename", "fn":
+		return applyFilenameOption(po, args)
+	case "return_attachment", "att":
+		return applyReturnAttachmentOption(po, args)
+	case "cachebuster", "cb":
+		return applyCacheBusterOption(po, args)
+	case "page", "frame":
+		return applyPageOption(po, args)
+	case "dpi":
+		return applyDPIOption(po, args)
+	case "dpr":
+		return applyDprOption(po, args)
+	case "video_thumbnail_second", "vts":
+		return applyVideoSecondOption(po, args)
+	case "kernel":
+		return applyKernelOption(po, args)
+	case "palette":
+		return applyPaletteOption(po, args)
+	case "dither":
+		return applyDitherOption(po, args)
+	case "jpeg_options", "jpgo":
+		return applyJpegOptionsOption(po, args)
+	case "png_options", "pngo":
+		return applyPngOptionsOption(po, args)
+	case "webp_options", "webpo":
+		return applyWebpOptionsOption(po, args)
+	case "denoise":
+		return applyDenoiseOption(po, args)
+	case "rotate", "rot":
+		return applyRotateOption(po, args)
+	case "flip":
+		return applyFlipOption(po, args)
+	case "flop":
+		return applyFlopOption(po, args)
+	case "background", "bg":
+		return applyBackgroundOption(po, args)
+	case "trim", "t":
+		return applyTrimOption(po, args)
+	case "crop", "c":
+		return applyCropOption(po, args)
+	case "blur", "bl":
+		return applyBlurOption(po, args)
+	case "saturation", "sa":
+		return applySaturationOption(po, args)
+	case "brightness", "br":
+		return applyBrightnessOption(po, args)
+	case "contrast", "co":
+		return applyContrastOption(po, args)
+	case "gamma":
+		return applyGammaOption(po, args)
+	case "autocontrast":
+		return applyAutoContrastOption(po, args)
+	case "equalize":
+		return applyEqualizeOption(po, args)
+	case "vignette":
+		return applyVignetteOption(po, args)
+	case "ar", "aspect_ratio":
+		return applyAspectRatioOption(po, args)
+	case "extend_ar", "extend_aspect_ratio":
+		return applyExtendAspectRatioOption(po, args)
+	case "extend", "ex":
+		return applyExtendOption(po, args)
+	case "text", "txt":
+		return applyTextOption(po, args)
+	case "border", "bd":
+		return applyBorderOption(po, args)
+	case "rounded_corners", "rc":
+		return applyRoundedCornersOption(po, args)
+	case "pad_bg", "padding_background":
+		return applyPadBackgroundOption(po, args)
+	}
+
+	return fmt.Errorf("Unknown processing option: %s", name)
+}
+
+func validateProcessingOptions(po processingOptions) error {
+	if po.Width > conf.MaxResultWidth || po.Height > conf.MaxResultHeight {
+		return fmt.Errorf("Result image is too big: %dx%d", po.Width, po.Height)
+	}
+
+	if po.Width*po.Height > conf.MaxResultResolution {
+		return fmt.Errorf("Result image is too big: %dx%d", po.Width, po.Height)
+	}
+
+	if po.Format != SVG && !vipsTypeSupportSave[po.Format] {
+		return errors.New("Resulting image type not supported")
+	}
+
+	return nil
+}
+
+// resolveFormat passes SVG images through when the resulting format isn't specified
+func resolveFormat(po *processingOptions, imgtype imageType) {
+	if imgtype == SVG && !po.FormatSet && len(po.Pipelines) == 0 {
+		po.Format = SVG
+	}
+}
+
+// negotiateFormat chooses the resulting format supported by the client
+// when the format isn't specified explicitly
+func negotiateFormat(po *processingOptions, r *http.Request) {
+	defer applyFormatQuality(po)
+
+	if po.FormatSet || po.Format == SVG {
+		return
+	}
+
+	accept := r.Header.Get("Accept")
+
+	for _, name := range conf.FormatPreference {
+		f := imageTypes[name]
+
+		if formatDetectionEnabled(f) && vipsTypeSupportSave[f] && strings.Contains(accept, mimes[f]) {
+			po.Format = f
+			return
+		}
+	}
+}
+
+// applyFormatQuality applies the default quality of the resulting format. It should be called
+// after the format is negotiated. AVIF has its own default quality since it looks much better
+// than JPEG or WebP with the same one
+func applyFormatQuality(po *processingOptions) {
+	if po.Format == AVIF && !po.QualitySet && conf.AvifQuality > 0 {
+		po.Quality = conf.AvifQuality
+	}
+}
+
+func formatDetectionEnabled(f imageType) bool {
+	switch f {
+	case AVIF:
+		return conf.EnableAvifDetection
+	case WEBP:
+		return conf.EnableWebpDetection
+	case JXL:
+		return conf.EnableJxlDetection
+	}
+	return false
+}
+
+// formatNegotiationEnabled returns true if the resulting format may depend on the Accept header
+func formatNegotiationEnabled() bool {
+	return conf.EnableAvifDetection || conf.EnableWebpDetection || conf.EnableJxlDetection
+}
+
+func parsePath(r *http.Request) (string, processingOptions, error) {
+	po := newProcessingOptions()
+	var err error
+
+	path := r.URL.Path
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	if len(parts) == 1 && len(r.URL.RawQuery) > 0 {
+		return parseQuery(r)
+	}
+
+	if len(parts) < 2 {
+		return "", po, errors.New("Invalid path")
+	}
+
+	token := parts[0]
+
+	if err = validatePath(token, strings.TrimPrefix(path, fmt.Sprintf("/%s", token))); err != nil {
+		return "", po, err
+	}
+
+	if conf.OnlyPresets {
+		return parsePresetsPath(po, parts, r)
+	}
+
+	optionsStart := 1
+
+	// The positional part is optional: if the path doesn't start with a resizing type,
+	// all the parameters are passed as options
+	if rt, ok := resizeTypes[parts[1]]; ok {
+		if len(parts) < 7 {
+			return "", po, errors.New("Invalid path")
+		}
+
+		po.Resize = rt
+
+		if po.Width, err = strconv.Atoi(parts[2]); err != nil || po.Width < 0 {
+			return "", po, fmt.Errorf("Invalid width: %s", parts[2])
+		}
+
+		if po.Height, err = strconv.Atoi(parts[3]); err != nil || po.Height < 0 {
+			return "", po, fmt.Errorf("Invalid height: %s", parts[3])
+		}
+
+		if g, ok := gravityTypes[parts[4]]; ok {
+			po.Gravity = gravityOptions{Type: g}
+		} else {
+			return "", po, fmt.Errorf("Invalid gravity: %s", parts[4])
+		}
+
+		po.Enlarge = parts[5] != "0"
+
+		optionsStart = 6
+	}
+
+	// Options are the segments containing ':' which can't appear in the encoded URL.
+	// The pipelines are separated with the "-" segments
+	optionsEnd := optionsStart
+	for optionsEnd < len(parts)-1 && (strings.Contains(parts[optionsEnd], ":") || parts[optionsEnd] == pipelineSeparator) {
+		optionsEnd++
+	}
+
+	var pipelines []processingOptions
+
+	for _, option := range parts[optionsStart:optionsEnd] {
+		if option == pipelineSeparator {
+			if len(pipelines) >= maxPipelines-1 {
+				return "", po, fmt.Errorf("Too many pipelines, max: %d", maxPipelines)
+			}
+			if err = finalizePipeline(&po); err != nil {
+				return "", po, err
+			}
+			pipelines = append(pipelines, po)
+			po = newProcessingOptions()
+			continue
+		}
+
+		args := strings.Split(option, ":")
+		if err = applyProcessingOption(&po, args[0], args[1:]); err != nil {
+			return "", po, err
+		}
+	}
+
+	po.Pipelines = pipelines
+
+	imgURL, extension, err := parseSourceURL(parts[optionsEnd:])
+	if err != nil {
+		return "", po, err
+	}
+
+	if err = finalizeProcessingOptions(&po, extension, r); err != nil {
+		return "", po, err
+	}
+
+	return imgURL, po, nil
+}
+
+// finalizePipeline prepares the options of the pipeline whose result is processed by the next one.
+// The result is saved losslessly keeping the metadata, so the next pipeline gets it as is
+func finalizePipeline(po *processingOptions) error {
+	po.Format = PNG
+	po.FormatSet = true
+	po.PaletteColors = 0
+	po.PngInterlaced = false
+	po.Metadata = METADATA_KEEP
+	po.MaxBytes = 0
+	po.Autoquality = AUTOQUALITY_NONE
+
+	return validateProcessingOptions(*po)
+}
+
+// parsePresetsPath parses the path in the presets-only mode: /%signature/%preset1:%preset2/%encoded_url
+func parsePresetsPath(po processingOptions, parts []string, r *http.Request) (string, processingOptions, error) {
+	if len(parts) < 3 {
+		return "", po, errors.New("Invalid path")
+	}
+
+	if err := applyPresetOption(&po, strings.Split(parts[1], ":")); err != nil {
+		return "", po, err
+	}
+
+	imgURL, extension, err := parseSourceURL(parts[2:])
+	if err != nil {
+		return "", po, err
+	}
+
+	if err = finalizeProcessingOptions(&po, extension, r); err != nil {
+		return "", po, err
+	}
+
+	return imgURL, po, nil
+}
+
+// finalizeProcessingOptions applies the variant and the resulting format, and validates the result
+func finalizeProcessingOptions(po *processingOptions, extension string, r *http.Request) error {
+	if conf.EnableClientHints {
+		applyClientHints(po, r)
+	}
+
+	// Variant options are applied last so they can't be overridden
+	if len(po.VariantGroup) > 0 {
+		v := chooseVariant(po.VariantGroup, r)
+		if err := applyVariant(po, v); err != nil {
+			return err
+		}
+		po.Variant = v.Name
+	}
+
+	// The extension overrides the format option
+	if len(extension) > 0 {
+		if f, ok := imageTypes[extension]; ok {
+			po.Format = f
+			po.FormatSet = true
+		} else {
+			return fmt.Errorf("Invalid image format: %s", extension)
+		}
+	}
+
+	return validateProcessingOptions(*po)
+}
+
+// parseQuery parses the query string request style: /%signature?url=%source_url&width=300&...
+// The signature is calculated for the "/?%query" string
+func parseQuery(r *http.Request) (string, processingOptions, error) {
+	po := newProcessingOptions()
+	var err error
+
+	token := strings.TrimPrefix(r.URL.Path, "/")
+
+	if err = validatePath(token, "/?"+r.URL.RawQuery); err != nil {
+		return "", po, err
+	}
+
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return "", po, errors.New("Invalid query")
+	}
+
+	imgURL := query.Get("url")
+	if len(imgURL) == 0 {
+		return "", po, errors.New("Source URL is not defined")
+	}
+
+	// Apply the parameters in a stable order. Presets go first, so the other parameters
+	// override them like in the path request style
+	names := make([]string, 0, len(query))
+	for name := range query {
+		if name != "preset" && name != "pr" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range []string{"pr", "preset"} {
+		if _, ok := query[name]; ok {
+			names = append([]string{name}, names...)
+		}
+	}
+
+	for _, name := range names {
+		values := query[name]
+		value := values[len(values)-1]
+
+		if name == "url" {
+			continue
+		}
+
+		if conf.OnlyPresets && name != "preset" && name != "pr" {
+			return "", po, fmt.Errorf("Only presets are allowed, got: %s", name)
+		}
+
+		if err = applyProcessingOption(&po, name, strings.Split(value, ":")); err != nil {
+			return "", po, err
+		}
+	}
+
+	if err = finalizeProcessingOptions(&po, "", r); err != nil {
+		return "", po, err
+	}
+
+	return imgURL, po, nil
+}
+
+// parseSourceURL extracts the source URL and the resulting image extension from
+// the path parts. The source URL is either Base64-encoded (%encoded_url.%extension)
+// or plain (plain/%source_url@%extension)
+func parseSourceURL(parts []string) (string, string, error) {
+	if len(parts) > 1 && parts[0] == "plain" {
+		source := strings.Join(parts[1:], "/")
+		extension := ""
+
+		// "@" can also appear in the URL credentials, so it's not an extension if it's followed by a path
+		if i := strings.LastIndex(source, "@"); i >= 0 && !strings.ContainsAny(source[i+1:], "/:") {
+			source, extension = source[:i], source[i+1:]
+		}
+
+		return source, extension, nil
+	}
+
+	filenameParts := strings.Split(strings.Join(parts, ""), ".")
+
+	filename, err := base64.RawURLEncoding.DecodeString(filenameParts[0])
+	if err != nil {
+		return "", "", errors.New("Invalid filename encoding")
+	}
+
+	if len(filenameParts) < 2 {
+		return string(filename), "", nil
+	}
+
+	return string(filename), filenameParts[1], nil
+}
+
+// parseExifPath parses the /exif/%signature/%encoded_url path
+func parseExifPath(r *http.Request) (string, error) {
+	path := strings.TrimPrefix(r.URL.Path, "/exif")
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	if len(parts) < 2 {
+		return "", errors.New("Invalid path")
+	}
+
+	token := parts[0]
+
+	// The endpoint is signed too, so the processing URL signature can't be used here
+	if err := validatePath(token, "/exif"+strings.TrimPrefix(path, fmt.Sprintf("/%s", token))); err != nil {
+		return "", err
+	}
+
+	imgURL, _, err := parseSourceURL(parts[1:])
+
+	return imgURL, err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type cachedResult struct {
+	data         []byte
+	po           processingOptions
+	originHeader http.Header
+	eTag         string
+	expires      time.Time
+	// refreshing is true while the stale result is being processed again
+	refreshing bool
+}
+
+var (
+	results   = make(map[string]*cachedResult)
+	resultsMu sync.Mutex
+)
+
+// resultCacheKey identifies the result by the source URL and the processing options,
+// including the ones that depend on the request headers
+func resultCacheKey(imgURL string, po *processingOptions) string {
+	return imgURL + "\x00" + optionsHash(po)
+}
+
+func resultStaleTTL() time.Duration {
+	return time.Duration(conf.ResultCacheStaleTTL) * time.Second
+}
+
+// getCachedResult returns the cached result. refresh is true if the result is stale
+// and the caller should refresh it. Only one caller is asked to refresh the result,
+// the rest get the stale one meanwhile
+func getCachedResult(key string) (res cachedResult, refresh bool, ok bool) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	c, found := results[key]
+	if !found {
+		return
+	}
+
+	now := time.Now()
+
+	if now.After(c.expires.Add(resultStaleTTL())) {
+		delete(results, key)
+		return
+	}
+
+	if now.After(c.expires) && !c.refreshing {
+		c.refreshing = true
+		refresh = true
+	}
+
+	return *c, refresh, true
+}
+
+type resultCacheInfo struct {
+	Size  int `json:"size"`
+	Max   int `json:"max"`
+	Bytes int `json:"bytes"`
+}
+
+func resultCacheStats() resultCacheInfo {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	info := resultCacheInfo{Size: len(results), Max: conf.ResultCacheSize}
+	for _, c := range results {
+		info.Bytes += len(c.data)
+	}
+
+	return info
+}
+
+func flushResults() {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	results = make(map[string]*cachedResult)
+}
+
+// storeResult caches the processed image for its TTL. The results that shouldn't be cached
+// by the clients aren't cached by imgproxy too. It returns false if the result wasn't cached
+func storeResult(key string, data []byte, po processingOptions, originHeader http.Header, eTag string) bool {
+	ttl := calcTTL(originHeader, po)
+	if ttl <= 0 {
+		return false
+	}
+
+	if conf.CacheControlPassthrough && !po.TTLSet && originHeader != nil {
+		if private, noStore := originRestrictions(originHeader); private || noStore {
+			return false
+		}
+	}
+
+	now := time.Now()
+
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	if _, ok := results[key]; !ok && len(results) >= conf.ResultCacheSize {
+		for k, c := range results {
+			if now.After(c.expires.Add(resultStaleTTL())) {
+				delete(results, k)
+			}
+		}
+
+		// If nothing is expired, drop an arbitrary result to make room for the new one
+		if len(results) >= conf.ResultCacheSize {
+			for k := range results {
+				delete(results, k)
+				break
+			}
+		}
+	}
+
+	results[key] = &cachedResult{
+		data:         data,
+		po:           po,
+		originHeader: originHeader,
+		eTag:         eTag,
+		expires:      now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	return true
+}
+
+// finishRefresh lets the next request refresh the stale result again
+func finishRefresh(key string) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	if c, ok := results[key]; ok {
+		c.refreshing = false
+	}
+}
+
+// refreshResult downloads and processes the image again and replaces the stale result.
+// It's called in the background, so the errors are only logged
+func (h *httpHandler) refreshResult(key, imgURL string, po processingOptions) {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			logWarning("Can't refresh the cached result of %s: %v", sanitizeURL(imgURL), sanitizeMessage(fmt.Sprint(rerr)))
+
+			// Let the next request try again
+			finishRefresh(key)
+		}
+	}()
+
+	h.lock()
+	defer h.unlock()
+
+	t := startTimer(time.Duration(po.Timeout)*time.Second, "Processing")
+
+	optsHash := optionsHash(&po)
+
+	b, imgtype, originHeader, err := downloadImage(imgURL, po, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	resolveFormat(&po, imgtype)
+
+	eTag := ""
+	if conf.ETagEnabled {
+		eTag = calcETag(b, originHeader, optsHash)
+	}
+
+	if b, err = processImage(b, imgtype, po, t); err != nil {
+		panic(err)
+	}
+
+	// The stale result is kept if the fresh one can't be cached
+	if !storeResult(key, b, po, originHeader, eTag) {
+		finishRefresh(key)
+	}
+}
+
+func respondWithCachedResult(reqID string, r *http.Request, rw http.ResponseWriter, res cachedResult, imgURL string, t *timer) {
+	if len(res.eTag) > 0 {
+		rw.Header().Set("ETag", res.eTag)
+
+		if res.eTag == r.Header.Get("If-None-Match") {
+			panic(notModifiedErr)
+		}
+	}
+
+	if notModifiedSince(r, res.originHeader) {
+		panic(notModifiedErr)
+	}
+
+	// The clients shouldn't cache the result longer than it's fresh
+	po := res.po
+	po.TTL = maxInt(int(time.Until(res.expires).Seconds()), 0)
+	po.TTLSet = true
+
+	respondWithImage(reqID, r, rw, res.data, imgURL, po, res.originHeader, t.Since())
+}
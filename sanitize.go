@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redactedValue = "REDACTED"
+
+// messageURLRe matches the URLs included in the error messages
+var messageURLRe = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// sanitizeRequestURI hides the URL signature so it can't be reused from logs
+func sanitizeRequestURI(r *http.Request) string {
+	if conf.LogFullURLs {
+		return r.URL.RequestURI()
+	}
+
+	path := r.URL.Path
+
+	prefix := ""
+	if strings.HasPrefix(path, "/exif/") {
+		prefix = "/exif"
+		path = strings.TrimPrefix(path, prefix)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+
+	// Query string request style: /%signature?url=%source_url&...
+	if len(parts) == 1 && len(prefix) == 0 && len(r.URL.RawQuery) > 0 {
+		return fmt.Sprintf("/%s?%s", redactedValue, sanitizeQuery(r.URL.RawQuery))
+	}
+
+	if len(parts) < 2 {
+		return r.URL.Path
+	}
+
+	return fmt.Sprintf("%s/%s/%s", prefix, redactedValue, sanitizeSource(parts[1]))
+}
+
+// sanitizeSource sanitizes the source URL in the path after the signature.
+// The options are skipped the same way parsePath does it. Encoded source URLs are encoded again
+// after sanitizing since Base64 doesn't hide anything
+func sanitizeSource(path string) string {
+	segments := strings.Split(path, "/")
+
+	start := 0
+	if _, ok := resizeTypes[segments[0]]; ok && len(segments) >= 6 {
+		start = 5
+	}
+	for start < len(segments)-1 && (strings.Contains(segments[start], ":") || segments[start] == pipelineSeparator) {
+		start++
+	}
+
+	source, extension, err := parseSourceURL(segments[start:])
+	if err != nil || len(source) == 0 {
+		return path
+	}
+
+	sanitized := sanitizeURL(source)
+
+	if segments[start] == "plain" {
+		sanitized = "plain/" + sanitized
+		if len(extension) > 0 {
+			sanitized += "@" + extension
+		}
+	} else {
+		if sanitized == source {
+			return path
+		}
+
+		sanitized = base64.RawURLEncoding.EncodeToString([]byte(sanitized))
+		if len(extension) > 0 {
+			sanitized += "." + extension
+		}
+	}
+
+	return strings.Join(append(segments[:start:start], sanitized), "/")
+}
+
+// sanitizeOptions hides credentials and query values of the watermark and layer URLs
+func sanitizeOptions(po processingOptions) processingOptions {
+	if conf.LogFullURLs {
+		return po
+	}
+
+	if len(po.Watermark.URL) > 0 {
+		po.Watermark.URL = sanitizeURL(po.Watermark.URL)
+	}
+
+	if len(po.Layers) > 0 {
+		layers := make([]watermarkOptions, len(po.Layers))
+		for i, l := range po.Layers {
+			if len(l.URL) > 0 {
+				l.URL = sanitizeURL(l.URL)
+			}
+			layers[i] = l
+		}
+		po.Layers = layers
+	}
+
+	if len(po.Pipelines) > 0 {
+		pipelines := make([]processingOptions, len(po.Pipelines))
+		for i, p := range po.Pipelines {
+			pipelines[i] = sanitizeOptions(p)
+		}
+		po.Pipelines = pipelines
+	}
+
+	return po
+}
+
+// sanitizeQuery sanitizes the source URL passed in the query string
+func sanitizeQuery(rawQuery string) string {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return redactedValue
+	}
+
+	if imgURL := query.Get("url"); len(imgURL) > 0 {
+		query.Set("url", sanitizeURL(imgURL))
+	}
+
+	return query.Encode()
+}
+
+// sanitizeURL hides credentials and query values of the source URL
+func sanitizeURL(s string) string {
+	if conf.LogFullURLs {
+		return s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return redactedValue
+	}
+
+	if u.User != nil {
+		u.User = url.User(redactedValue)
+	}
+
+	if len(u.RawQuery) > 0 {
+		query := u.Query()
+		for k := range query {
+			query.Set(k, redactedValue)
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String()
+}
+
+// sanitizeMessage hides credentials and query values of the URLs found in the message
+func sanitizeMessage(msg string) string {
+	if conf.LogFullURLs {
+		return msg
+	}
+
+	return messageURLRe.ReplaceAllStringFunc(msg, sanitizeURL)
+}
+
+func sanitizeError(err error) error {
+	if uerr, ok := err.(*url.Error); ok {
+		uerr.URL = sanitizeURL(uerr.URL)
+	}
+	return err
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
 	"crypto/subtle"
-	"encoding/base64"
-	"errors"
 	"fmt"
+	"image"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
-	"strconv"
+	"path"
 	"strings"
 	"time"
 
@@ -20,6 +21,42 @@ var mimes = map[imageType]string{
 	JPEG: "image/jpeg",
 	PNG:  "image/png",
 	WEBP: "image/webp",
+	AVIF: "image/avif",
+	SVG:  "image/svg+xml",
+	JXL:  "image/jxl",
+}
+
+var extensions = map[imageType]string{
+	JPEG: "jpg",
+	PNG:  "png",
+	WEBP: "webp",
+	AVIF: "avif",
+	SVG:  "svg",
+	JXL:  "jxl",
+}
+
+// contentDisposition builds the Content-Disposition header with the name of the resulting file.
+// The extension always matches the resulting format
+func contentDisposition(imgURL string, po processingOptions) string {
+	filename := po.Filename
+
+	if len(filename) == 0 {
+		if u, err := url.Parse(imgURL); err == nil {
+			filename = path.Base(u.Path)
+			filename = strings.TrimSuffix(filename, path.Ext(filename))
+		}
+
+		if filename == "" || filename == "." || filename == "/" {
+			filename = "image"
+		}
+	}
+
+	disposition := "inline"
+	if po.ReturnAttachment {
+		disposition = "attachment"
+	}
+
+	return mime.FormatMediaType(disposition, map[string]string{"filename": filename + "." + extensions[po.Format]})
 }
 
 type httpHandler struct {
@@ -30,107 +67,156 @@ func newHTTPHandler() *httpHandler {
 	return &httpHandler{make(chan struct{}, conf.Concurrency)}
 }
 
-func parsePath(r *http.Request) (string, processingOptions, error) {
-	var po processingOptions
-	var err error
+func logResponse(status int, msg string) {
+	var color int
+	var level logLevel
 
-	path := r.URL.Path
-	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if status >= 500 {
+		color = 31
+		level = logLevelError
+	} else if status >= 400 {
+		color = 33
+		level = logLevelWarn
+	} else {
+		color = 32
+		level = logLevelInfo
+	}
 
-	if len(parts) < 7 {
-		return "", po, errors.New("Invalid path")
+	if !logLevelEnabled(level) {
+		return
 	}
 
-	token := parts[0]
+	log.Printf("|\033[7;%dm %d \033[0m| %s\n", color, status, msg)
+}
 
-	if err = validatePath(token, strings.TrimPrefix(path, fmt.Sprintf("/%s", token))); err != nil {
-		return "", po, err
+func respondWithImage(reqID string, r *http.Request, rw http.ResponseWriter, data []byte, imgURL string, po processingOptions, originHeader http.Header, duration time.Duration) {
+	gzipped := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && conf.GZipCompression > 0
+
+	ttl := calcTTL(originHeader, po)
+
+	rw.Header().Set("Expires", time.Now().Add(time.Second*time.Duration(ttl)).Format(http.TimeFormat))
+	rw.Header().Set("Cache-Control", cacheControl(ttl, originHeader, po))
+	rw.Header().Set("Content-Type", mimes[po.Format])
+	rw.Header().Set("Content-Disposition", contentDisposition(imgURL, po))
+
+	// Scripts are removed from SVG images anyway, but the browser shouldn't run them if some slip through
+	if po.Format == SVG {
+		rw.Header().Set("Content-Security-Policy", "script-src 'none'")
 	}
 
-	if r, ok := resizeTypes[parts[1]]; ok {
-		po.Resize = r
-	} else {
-		return "", po, fmt.Errorf("Invalid resize type: %s", parts[1])
+	if lm := originHeader.Get("Last-Modified"); conf.LastModifiedEnabled && len(lm) > 0 {
+		rw.Header().Set("Last-Modified", lm)
 	}
 
-	if po.Width, err = strconv.Atoi(parts[2]); err != nil {
-		return "", po, fmt.Errorf("Invalid width: %s", parts[2])
+	if len(po.VariantGroup) > 0 {
+		rw.Header().Set("X-Imgproxy-Variant", fmt.Sprintf("%s/%s", po.VariantGroup, po.Variant))
+		rw.Header().Add("Vary", conf.VariantKeyHeader)
 	}
 
-	if po.Height, err = strconv.Atoi(parts[3]); err != nil {
-		return "", po, fmt.Errorf("Invalid height: %s", parts[3])
+	if conf.EnableClientHints {
+		setClientHintsHeaders(rw, po)
 	}
 
-	if g, ok := gravityTypes[parts[4]]; ok {
-		po.Gravity = g
-	} else {
-		return "", po, fmt.Errorf("Invalid gravity: %s", parts[4])
+	if formatNegotiationEnabled() {
+		rw.Header().Add("Vary", "Accept")
 	}
 
-	po.Enlarge = parts[5] != "0"
+	if gzipped {
+		var buf bytes.Buffer
 
-	filenameParts := strings.Split(strings.Join(parts[6:], ""), ".")
+		gz, _ := gzip.NewWriterLevel(&buf, conf.GZipCompression)
+		gz.Write(data)
+		gz.Close()
 
-	if len(filenameParts) < 2 {
-		po.Format = imageTypes["jpg"]
-	} else if f, ok := imageTypes[filenameParts[1]]; ok {
-		po.Format = f
-	} else {
-		return "", po, fmt.Errorf("Invalid image format: %s", filenameParts[1])
-	}
+		data = buf.Bytes()
 
-	if !vipsTypeSupportSave[po.Format] {
-		return "", po, errors.New("Resulting image type not supported")
+		rw.Header().Set("Content-Encoding", "gzip")
 	}
 
-	filename, err := base64.RawURLEncoding.DecodeString(filenameParts[0])
-	if err != nil {
-		return "", po, errors.New("Invalid filename encoding")
+	if conf.IntegrityHeaders {
+		setIntegrityHeaders(rw, r, data)
 	}
 
-	return string(filename), po, nil
+	// ServeContent handles Range and If-Range headers
+	http.ServeContent(rw, r, "", time.Time{}, bytes.NewReader(data))
+
+	logResponse(200, fmt.Sprintf("[%s] Processed in %s: %s; %+v", reqID, duration, sanitizeURL(imgURL), sanitizeOptions(po)))
 }
 
-func logResponse(status int, msg string) {
-	var color int
+func serveExif(reqID string, rw http.ResponseWriter, r *http.Request) {
+	imgURL, err := parseExifPath(r)
+	if err != nil {
+		panic(newError(404, err.Error(), "Invalid image url"))
+	}
 
-	if status >= 500 {
-		color = 31
-	} else if status >= 400 {
-		color = 33
-	} else {
-		color = 32
+	t := startTimer(time.Duration(conf.WriteTimeout)*time.Second, "Processing")
+
+	if _, err = url.ParseRequestURI(imgURL); err != nil {
+		panic(newError(404, err.Error(), "Invalid image url"))
 	}
 
-	log.Printf("|\033[7;%dm %d \033[0m| %s\n", color, status, msg)
-}
+	po := newProcessingOptions()
 
-func respondWithImage(reqID string, r *http.Request, rw http.ResponseWriter, data []byte, imgURL string, po processingOptions, duration time.Duration) {
-	gzipped := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && conf.GZipCompression > 0
+	b, imgtype, originHeader, err := downloadImage(imgURL, po, nil)
+	if err != nil {
+		panic(newError(404, err.Error(), "Image is unreachable"))
+	}
 
-	rw.Header().Set("Expires", time.Now().Add(time.Second*time.Duration(conf.TTL)).Format(http.TimeFormat))
-	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", conf.TTL))
-	rw.Header().Set("Content-Type", mimes[po.Format])
+	t.Check()
 
-	if gzipped {
-		rw.Header().Set("Content-Encoding", "gzip")
+	imgconf, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		panic(newError(500, err.Error(), "Error occurred while reading image metadata"))
 	}
 
-	rw.WriteHeader(200)
+	info := map[string]interface{}{
+		"format": format,
+		"width":  imgconf.Width,
+		"height": imgconf.Height,
+		"exif":   map[string]interface{}{},
+		"xmp":    map[string]string{},
+	}
 
-	if gzipped {
-		gz, _ := gzip.NewWriterLevel(rw, conf.GZipCompression)
-		gz.Write(data)
-		gz.Close()
-	} else {
-		rw.Write(data)
+	if exif, ok := findExif(b, imgtype); ok {
+		info["exif"] = parseExif(exif, conf.ExifGPS)
+	}
+
+	if xmp, ok := findXMP(b, imgtype); ok {
+		info["xmp"] = parseXMP(xmp)
 	}
 
-	logResponse(200, fmt.Sprintf("[%s] Processed in %s: %s; %+v", reqID, duration, imgURL, po))
+	ttl := calcTTL(originHeader, po)
+
+	rw.Header().Set("Expires", time.Now().Add(time.Second*time.Duration(ttl)).Format(http.TimeFormat))
+	rw.Header().Set("Cache-Control", cacheControl(ttl, originHeader, po))
+
+	respondWithJSON(rw, 200, info)
+
+	logResponse(200, fmt.Sprintf("[%s] Metadata extracted in %s: %s", reqID, t.Since(), sanitizeURL(imgURL)))
+}
+
+func wantsJSONErrors(r *http.Request) bool {
+	return conf.JSONErrors || strings.Contains(r.Header.Get("Accept"), "application/json")
 }
 
-func respondWithError(reqID string, rw http.ResponseWriter, err imgproxyError) {
-	logResponse(err.StatusCode, fmt.Sprintf("[%s] %s", reqID, err.Message))
+func respondWithError(reqID string, r *http.Request, rw http.ResponseWriter, err imgproxyError) {
+	logResponse(err.StatusCode, fmt.Sprintf("[%s] %s", reqID, sanitizeMessage(err.Message)))
+
+	rw.Header().Set("X-Request-ID", reqID)
+
+	if err.StatusCode == 304 {
+		rw.WriteHeader(err.StatusCode)
+		return
+	}
+
+	if wantsJSONErrors(r) {
+		respondWithJSON(rw, err.StatusCode, map[string]interface{}{
+			"error":      err.PublicMessage,
+			"code":       err.StatusCode,
+			"request_id": reqID,
+		})
+		return
+	}
 
 	rw.WriteHeader(err.StatusCode)
 	rw.Write([]byte(err.PublicMessage))
@@ -154,14 +240,18 @@ func (h *httpHandler) unlock() {
 func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	reqID, _ := nanoid.Nanoid()
 
-	log.Printf("[%s] GET: %s\n", reqID, r.URL.RequestURI())
+	if logLevelEnabled(logLevelInfo) {
+		log.Printf("[%s] GET: %s\n", reqID, sanitizeRequestURI(r))
+	}
+
+	defer trackRequest(reqID, r)()
 
 	defer func() {
-		if r := recover(); r != nil {
-			if err, ok := r.(imgproxyError); ok {
-				respondWithError(reqID, rw, err)
+		if rerr := recover(); rerr != nil {
+			if err, ok := rerr.(imgproxyError); ok {
+				respondWithError(reqID, r, rw, err)
 			} else {
-				respondWithError(reqID, rw, newUnexpectedError(r.(error), 4))
+				respondWithError(reqID, r, rw, newUnexpectedError(rerr, 4))
 			}
 		}
 	}()
@@ -179,26 +269,80 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	t := startTimer(time.Duration(conf.WriteTimeout)*time.Second, "Processing")
+	if strings.HasPrefix(r.URL.Path, "/exif/") {
+		serveExif(reqID, rw, r)
+		return
+	}
 
 	imgURL, procOpt, err := parsePath(r)
 	if err != nil {
 		panic(newError(404, err.Error(), "Invalid image url"))
 	}
 
+	t := startTimer(time.Duration(procOpt.Timeout)*time.Second, "Processing")
+
 	if _, err = url.ParseRequestURI(imgURL); err != nil {
 		panic(newError(404, err.Error(), "Invalid image url"))
 	}
 
-	b, imgtype, err := downloadImage(imgURL)
+	// The format is negotiated before downloading, so the options hash can be compared
+	// with the one from If-None-Match. SVG images are passed through anyway
+	negotiateFormat(&procOpt, r)
+
+	var resultKey string
+
+	if conf.ResultCacheSize > 0 {
+		resultKey = resultCacheKey(imgURL, &procOpt)
+
+		if res, refresh, ok := getCachedResult(resultKey); ok {
+			// The stale result is served right away while the fresh one is being processed
+			if refresh {
+				go h.refreshResult(resultKey, imgURL, procOpt)
+			}
+
+			respondWithCachedResult(reqID, r, rw, res, imgURL, t)
+			return
+		}
+	}
+
+	// The conditional request lets the origin skip sending the image if it wasn't modified
+	var reqHeader http.Header
+	var optsHash string
+
+	if conf.ETagEnabled {
+		optsHash = optionsHash(&procOpt)
+		reqHeader = originConditionalHeader(r, optsHash)
+	}
+	if ims := ifModifiedSince(r); len(ims) > 0 {
+		reqHeader = http.Header{"If-Modified-Since": {ims}}
+	}
+
+	b, imgtype, originHeader, err := downloadImage(imgURL, procOpt, reqHeader)
+	if err == errSourceNotModified || (err == nil && notModifiedSince(r, originHeader)) {
+		if conf.ETagEnabled && len(r.Header.Get("If-None-Match")) > 0 {
+			rw.Header().Set("ETag", r.Header.Get("If-None-Match"))
+		}
+		panic(notModifiedErr)
+	}
+	if err != nil && isCircuitOpenError(err) && len(circuitFallbackImage) > 0 {
+		// The fallback image shouldn't be cached longer than the circuit stays open
+		b, imgtype, originHeader, err = circuitFallbackImage, circuitFallbackImageType, nil, nil
+		procOpt.TTL = conf.CircuitBreakerTimeout
+		procOpt.TTLSet = true
+		resultKey = ""
+	}
 	if err != nil {
 		panic(newError(404, err.Error(), "Image is unreachable"))
 	}
 
+	resolveFormat(&procOpt, imgtype)
+
 	t.Check()
 
+	var eTag string
+
 	if conf.ETagEnabled {
-		eTag := calcETag(b, &procOpt)
+		eTag = calcETag(b, originHeader, optsHash)
 		rw.Header().Set("ETag", eTag)
 
 		if eTag == r.Header.Get("If-None-Match") {
@@ -215,5 +359,9 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	t.Check()
 
-	respondWithImage(reqID, r, rw, b, imgURL, procOpt, t.Since())
+	if len(resultKey) > 0 {
+		storeResult(resultKey, b, procOpt, originHeader, eTag)
+	}
+
+	respondWithImage(reqID, r, rw, b, imgURL, procOpt, originHeader, t.Since())
 }
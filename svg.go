@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// svgDangerousElements are removed from SVG images with all their content
+var svgDangerousElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+}
+
+// svgAnimationElements can change the attributes of other elements, so they're removed
+// if they target links or event handlers
+var svgAnimationElements = map[string]bool{
+	"set":              true,
+	"animate":          true,
+	"animatecolor":     true,
+	"animatemotion":    true,
+	"animatetransform": true,
+}
+
+// svgAllowedSchemes are the URL schemes allowed in links. Relative links don't have a scheme
+// and are allowed too. Data URLs are allowed only for raster images
+var svgAllowedSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+}
+
+func svgName(n xml.Name) string {
+	if len(n.Space) > 0 {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+func svgDangerousAttr(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+
+	// Event handlers: onload, onclick, etc.
+	if strings.HasPrefix(name, "on") {
+		return true
+	}
+
+	if name == "href" {
+		return !svgSafeURL(attr.Value)
+	}
+
+	return false
+}
+
+// svgSafeURL checks the URL scheme against the allowlist. Browsers ignore ASCII whitespace
+// and control characters in the scheme, so they're removed before the check
+func svgSafeURL(value string) bool {
+	value = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value))
+
+	i := strings.IndexAny(value, ":/?#")
+	if i < 0 || value[i] != ':' {
+		return true
+	}
+
+	if scheme := value[:i]; scheme != "data" {
+		return svgAllowedSchemes[scheme]
+	}
+
+	return strings.HasPrefix(value, "data:image/") && !strings.HasPrefix(value, "data:image/svg")
+}
+
+// svgDangerousAnimation checks if the animation element targets a link or an event handler
+func svgDangerousAnimation(t xml.StartElement) bool {
+	if !svgAnimationElements[strings.ToLower(t.Name.Local)] {
+		return false
+	}
+
+	for _, attr := range t.Attr {
+		if strings.ToLower(attr.Name.Local) != "attributename" {
+			continue
+		}
+
+		target := strings.ToLower(strings.TrimSpace(attr.Value))
+		if i := strings.LastIndex(target, ":"); i >= 0 {
+			target = target[i+1:]
+		}
+
+		if target == "href" || strings.HasPrefix(target, "on") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sanitizeSVG removes scripts, event handlers, unsafe links and animations of links from the SVG image.
+// DOCTYPE directives are removed too since they can define entities
+func sanitizeSVG(data []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+
+	// Depth of the dangerous element we're skipping, 0 if we aren't skipping anything
+	skipDepth := 0
+	depth := 0
+	hasRoot := false
+
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+
+			if skipDepth > 0 {
+				continue
+			}
+
+			if svgDangerousElements[strings.ToLower(t.Name.Local)] || svgDangerousAnimation(t) {
+				skipDepth = depth
+				continue
+			}
+
+			if depth == 1 {
+				if strings.ToLower(t.Name.Local) != "svg" {
+					return nil, errors.New("Source image is not a valid SVG")
+				}
+				hasRoot = true
+			}
+
+			buf.WriteString("<")
+			buf.WriteString(svgName(t.Name))
+			for _, attr := range t.Attr {
+				if svgDangerousAttr(attr) {
+					continue
+				}
+				buf.WriteString(" ")
+				buf.WriteString(svgName(attr.Name))
+				buf.WriteString(`="`)
+				xml.EscapeText(&buf, []byte(attr.Value))
+				buf.WriteString(`"`)
+			}
+			buf.WriteString(">")
+		case xml.EndElement:
+			if skipDepth > 0 {
+				if depth == skipDepth {
+					skipDepth = 0
+				}
+				depth--
+				continue
+			}
+			depth--
+
+			buf.WriteString("</")
+			buf.WriteString(svgName(t.Name))
+			buf.WriteString(">")
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			xml.EscapeText(&buf, t)
+		case xml.Comment:
+			if skipDepth > 0 {
+				continue
+			}
+			buf.WriteString("<!--")
+			buf.Write(t)
+			buf.WriteString("-->")
+		case xml.ProcInst:
+			// Only the XML declaration is kept, processing instructions like
+			// xml-stylesheet can load external resources
+			if skipDepth > 0 || t.Target != "xml" {
+				continue
+			}
+			buf.WriteString("<?xml ")
+			buf.Write(t.Inst)
+			buf.WriteString("?>")
+		}
+	}
+
+	if !hasRoot {
+		return nil, errors.New("Source image is not a valid SVG")
+	}
+
+	return buf.Bytes(), nil
+}
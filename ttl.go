@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// originTTL extracts the freshness lifetime from the origin response headers.
+// It returns false if the origin doesn't provide any caching headers
+func originTTL(header http.Header) (int, bool) {
+	if cc := header.Get("Cache-Control"); len(cc) > 0 {
+		for _, directive := range strings.Split(cc, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+
+			switch {
+			case directive == "no-store" || directive == "no-cache":
+				return 0, true
+			case strings.HasPrefix(directive, "max-age="):
+				if ttl, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+					return ttl, true
+				}
+			}
+		}
+	}
+
+	if exp := header.Get("Expires"); len(exp) > 0 {
+		expires, err := http.ParseTime(exp)
+		if err != nil {
+			// Invalid Expires means the response is already expired
+			return 0, true
+		}
+
+		now := time.Now()
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+
+		return maxInt(int(expires.Sub(now).Seconds()), 0), true
+	}
+
+	return 0, false
+}
+
+func calcTTL(originHeader http.Header, po processingOptions) int {
+	if po.TTLSet || !conf.CacheControlPassthrough || originHeader == nil {
+		return po.TTL
+	}
+
+	ttl, ok := originTTL(originHeader)
+	if !ok {
+		return po.TTL
+	}
+
+	if ttl < conf.MinTTL {
+		ttl = conf.MinTTL
+	}
+
+	if conf.MaxTTL > 0 && ttl > conf.MaxTTL {
+		ttl = conf.MaxTTL
+	}
+
+	return ttl
+}
+
+// originRestrictions returns true for the Cache-Control directives of the origin response
+// that restrict caching of the image, so they should be passed to the clients
+func originRestrictions(header http.Header) (private, noStore bool) {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "private":
+			private = true
+		case "no-store":
+			noStore = true
+		}
+	}
+
+	return
+}
+
+// cacheControl builds the Cache-Control header value for the response with the given TTL
+func cacheControl(ttl int, originHeader http.Header, po processingOptions) string {
+	private, noStore := conf.CacheControlPrivate, false
+
+	if conf.CacheControlPassthrough && !po.TTLSet && originHeader != nil {
+		originPrivate, originNoStore := originRestrictions(originHeader)
+		private = private || originPrivate
+		noStore = originNoStore
+	}
+
+	// No-store is passed only when the min TTL doesn't allow caching anyway
+	if ttl <= 0 {
+		if noStore {
+			return "no-store"
+		}
+		return "no-cache"
+	}
+
+	directives := []string{fmt.Sprintf("max-age=%d", ttl)}
+
+	if private {
+		directives = append(directives, "private")
+	} else {
+		directives = append(directives, "public")
+	}
+
+	// CDNs usually can keep the images longer than browsers since they can be purged
+	if conf.CacheControlSMaxAge > 0 && !private {
+		directives = append(directives, fmt.Sprintf("s-maxage=%d", conf.CacheControlSMaxAge))
+	}
+
+	if conf.CacheControlImmutable {
+		directives = append(directives, "immutable")
+	}
+
+	if conf.CacheControlStaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", conf.CacheControlStaleWhileRevalidate))
+	}
+
+	return strings.Join(directives, ", ")
+}
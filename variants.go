@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type variant struct {
+	Name    string   `yaml:"name"`
+	Options []string `yaml:"options"`
+}
+
+var variantGroups = make(map[string][]variant)
+
+func applyVariant(po *processingOptions, v variant) error {
+	for _, option := range v.Options {
+		args := strings.Split(option, ":")
+		if args[0] == "variant" {
+			return fmt.Errorf("Variant %s can't contain another variant", v.Name)
+		}
+		if err := applyProcessingOption(po, args[0], args[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func variantClientKey(r *http.Request) string {
+	if key := r.Header.Get(conf.VariantKeyHeader); len(key) > 0 {
+		return key
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+// chooseVariant deterministically picks the variant of the group for the client
+func chooseVariant(group string, r *http.Request) variant {
+	variants := variantGroups[group]
+
+	hash := fnv.New32a()
+	hash.Write([]byte(group))
+	hash.Write([]byte{0})
+	hash.Write([]byte(variantClientKey(r)))
+
+	return variants[int(hash.Sum32()%uint32(len(variants)))]
+}
+
+func initVariants() {
+	if len(conf.VariantsPath) == 0 {
+		return
+	}
+
+	src, err := ioutil.ReadFile(conf.VariantsPath)
+	if err != nil {
+		log.Fatalf("Can't read variants file: %s\n", err)
+	}
+
+	if err = yaml.Unmarshal(src, &variantGroups); err != nil {
+		log.Fatalf("Can't parse variants file: %s\n", err)
+	}
+
+	for group, variants := range variantGroups {
+		if len(variants) == 0 {
+			log.Fatalf("Variant group %s is empty\n", group)
+		}
+
+		for _, v := range variants {
+			if len(v.Name) == 0 {
+				log.Fatalf("Variant group %s contains a variant without a name\n", group)
+			}
+
+			po := newProcessingOptions()
+			if err := applyVariant(&po, v); err != nil {
+				log.Fatalf("Invalid variant %s/%s: %s\n", group, v.Name, err)
+			}
+		}
+	}
+}
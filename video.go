@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+func init() {
+	// Video dimensions are unknown until the frame is extracted, so they are checked after extracting
+	for _, brand := range []string{"isom", "iso2", "iso4", "iso5", "mp41", "mp42", "avc1", "M4V ", "dash"} {
+		image.RegisterFormat("mp4", "????ftyp"+brand, decodeUnsupported, decodeUnknownConfig)
+	}
+	image.RegisterFormat("webm", "\x1a\x45\xdf\xa3", decodeUnsupported, decodeUnknownConfig)
+}
+
+var ffmpegPath string
+
+func initVideo() {
+	if !conf.EnableVideoThumbnails {
+		return
+	}
+
+	path, err := exec.LookPath(conf.FFmpegPath)
+	if err != nil {
+		log.Fatalf("Can't find ffmpeg: %s\n", err)
+	}
+
+	ffmpegPath = path
+	vipsTypeSupportLoad[VIDEO] = true
+}
+
+// extractVideoFrame extracts the keyframe closest to the given second of the video
+// and returns it as a PNG image
+func extractVideoFrame(data []byte, second float64, timeout time.Duration) ([]byte, error) {
+	// Most of MP4 files can't be read from a pipe since their index is at the end,
+	// so we save the video to a temp file
+	f, err := ioutil.TempFile("", "imgproxy-video")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(
+		ffmpegPath,
+		"-v", "error",
+		"-ss", strconv.FormatFloat(second, 'f', -1, 64),
+		"-i", f.Name(),
+		"-frames:v", "1",
+		"-an",
+		"-f", "image2pipe",
+		"-c:v", "png",
+		"-",
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	killer := time.AfterFunc(timeout, func() { cmd.Process.Kill() })
+	defer killer.Stop()
+
+	if err = cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("Can't extract video frame: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	if stdout.Len() == 0 {
+		return nil, errors.New("Video doesn't have a frame at the given second")
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -1,4 +1,6 @@
+#include <math.h>
 #include <stdlib.h>
+#include <string.h>
 #include <vips/vips.h>
 #include <vips/vips7compat.h>
 
@@ -11,6 +13,36 @@
 #define VIPS_SUPPORT_GIF \
   VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 3)
 
+#define VIPS_SUPPORT_COMPOSITE \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6))
+
+#define VIPS_SUPPORT_WEBP_ANIMATION \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
+
+#define VIPS_SUPPORT_PNG_QUANTIZATION \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7))
+
+#define VIPS_SUPPORT_HEIF \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
+
+#define VIPS_SUPPORT_AVIF \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 10))
+
+#define VIPS_SUPPORT_AVIF_EFFORT \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 12))
+
+#define VIPS_SUPPORT_JXL \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 11))
+
+#define VIPS_SUPPORT_SUBSAMPLE_MODE \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 13))
+
+#define VIPS_SUPPORT_FIND_TRIM \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6))
+
+#define VIPS_SUPPORT_BUILTIN_ICC \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7))
+
 #define EXIF_ORIENTATION "exif-ifd0-Orientation"
 
 enum types {
@@ -18,7 +50,16 @@ enum types {
   JPEG,
   PNG,
   WEBP,
-  GIF
+  GIF,
+  TIFF,
+  PDF,
+  AVIF,
+  HEIF,
+  SVG,
+  VIDEO,
+  JXL,
+  BMP,
+  ICO
 };
 
 int
@@ -56,6 +97,24 @@ vips_type_find_load_go(int imgtype) {
   if (imgtype == GIF) {
     return vips_type_find("VipsOperation", "gifload");
   }
+  if (imgtype == TIFF) {
+    return vips_type_find("VipsOperation", "tiffload");
+  }
+  if (imgtype == PDF) {
+    return vips_type_find("VipsOperation", "pdfload");
+  }
+#if VIPS_SUPPORT_HEIF
+  if (imgtype == AVIF || imgtype == HEIF) {
+    return vips_type_find("VipsOperation", "heifload");
+  }
+#endif
+  if (imgtype == SVG) {
+    return vips_type_find("VipsOperation", "svgload");
+  }
+  // libvips doesn't have its own BMP and ICO loaders, they are loaded via ImageMagick
+  if (imgtype == BMP || imgtype == ICO) {
+    return vips_type_find("VipsOperation", "magickload");
+  }
   return 0;
 }
 
@@ -70,11 +129,21 @@ vips_type_find_save_go(int imgtype) {
   if (imgtype == WEBP) {
     return vips_type_find("VipsOperation", "webpsave_buffer");
   }
+#if VIPS_SUPPORT_AVIF
+  if (imgtype == AVIF) {
+    return vips_type_find("VipsOperation", "heifsave_buffer");
+  }
+#endif
+#if VIPS_SUPPORT_JXL
+  if (imgtype == JXL) {
+    return vips_type_find("VipsOperation", "jxlsave_buffer");
+  }
+#endif
   return 0;
 }
 
 int
-vips_load_buffer(void *buf, size_t len, int imgtype, int shrink, VipsImage **out) {
+vips_load_buffer(void *buf, size_t len, int imgtype, int shrink, int page, VipsImage **out) {
   switch (imgtype) {
     case JPEG:
       if (shrink > 1) {
@@ -84,18 +153,57 @@ vips_load_buffer(void *buf, size_t len, int imgtype, int shrink, VipsImage **out
     case PNG:
       return vips_pngload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
     case WEBP:
+      if (page > 0) {
+      #if VIPS_SUPPORT_WEBP_ANIMATION
+        return vips_webpload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "shrink", shrink, "page", page, NULL);
+      #else
+        vips_error("vips_load_buffer", "Animated WebP is not supported by used version of libvips");
+        return 1;
+      #endif
+      }
       if (shrink > 1) {
         return vips_webpload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "shrink", shrink, NULL);
       }
       return vips_webpload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
     #if VIPS_SUPPORT_GIF
     case GIF:
-      return vips_gifload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+      return vips_gifload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "page", page, NULL);
     #endif
+    case TIFF:
+      return vips_tiffload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "page", page, NULL);
+    case PDF:
+      return vips_pdfload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "page", page, NULL);
+    #if VIPS_SUPPORT_HEIF
+    case AVIF:
+    case HEIF:
+      return vips_heifload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "page", page, NULL);
+    #endif
+    case SVG:
+      return vips_svgload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+    case BMP:
+      return vips_magickload_buffer(buf, len, out, NULL);
+    case ICO:
+      return vips_magickload_buffer(buf, len, out, "page", page, NULL);
   }
   return 1;
 }
 
+int
+vips_svgload_go(void *buf, size_t len, double scale, double dpi, VipsImage **out) {
+  if (dpi > 0) {
+    return vips_svgload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "scale", scale, "dpi", dpi, NULL);
+  }
+  return vips_svgload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "scale", scale, NULL);
+}
+
+int
+vips_pdfload_go(void *buf, size_t len, int page, double scale, double dpi, VipsImage **out) {
+  if (dpi > 0) {
+    return vips_pdfload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "page", page, "scale", scale, "dpi", dpi, NULL);
+  }
+  return vips_pdfload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "page", page, "scale", scale, NULL);
+}
+
 int
 vips_get_exif_orientation(VipsImage *image) {
 	const char *orientation;
@@ -108,6 +216,238 @@ vips_get_exif_orientation(VipsImage *image) {
 	return 1;
 }
 
+int
+vips_add_alpha_go(VipsImage *in, VipsImage **out) {
+  return vips_bandjoin_const1(in, out, 255, NULL);
+}
+
+int
+vips_remove_alpha_go(VipsImage *in, VipsImage **out) {
+  return vips_extract_band(in, out, 0, "n", in->Bands - 1, NULL);
+}
+
+int
+vips_apply_opacity(VipsImage *in, VipsImage **out, double opacity) {
+  VipsImage *tmp;
+  int bands = in->Bands;
+  double *a = malloc(bands * sizeof(double));
+  double *b = malloc(bands * sizeof(double));
+
+  for (int i = 0; i < bands; i++) {
+    a[i] = 1.0;
+    b[i] = 0.0;
+  }
+  a[bands - 1] = opacity;
+
+  int res = vips_linear(in, &tmp, a, b, bands, NULL);
+
+  free(a);
+  free(b);
+
+  if (res) return res;
+
+  res = vips_cast(tmp, out, in->BandFmt, NULL);
+  g_object_unref(tmp);
+
+  return res;
+}
+
+int
+vips_composite_go(VipsImage *base, VipsImage *overlay, VipsImage **out, int left, int top, VipsBlendMode mode) {
+#if VIPS_SUPPORT_COMPOSITE
+  VipsImage *embedded, *composed;
+
+  if (vips_embed(overlay, &embedded, left, top, base->Xsize, base->Ysize, "extend", VIPS_EXTEND_BLACK, NULL))
+    return 1;
+
+  int res = vips_composite2(base, embedded, &composed, mode, NULL);
+  g_object_unref(embedded);
+
+  if (res) return res;
+
+  res = vips_cast(composed, out, base->BandFmt, NULL);
+  g_object_unref(composed);
+
+  return res;
+#else
+  vips_error("vips_composite_go", "Watermarks are not supported by used version of libvips");
+  return 1;
+#endif
+}
+
+// Renders the text of the given colour with the transparent background.
+// The text is escaped, so Pango markup isn't interpreted
+int
+vips_text_go(VipsImage **out, const char *text, const char *font, int width, int r, int g, int b) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+
+  char *escaped = g_markup_escape_text(text, -1);
+
+  int res = vips_text(&t[0], escaped, "font", font, "width", width, "dpi", 72, NULL);
+  g_free(escaped);
+
+  if (res) {
+    g_object_unref(base);
+    return 1;
+  }
+
+  double color[3] = {r, g, b};
+
+  // The text mask becomes the alpha of the solid colour image
+  if (!(t[1] = vips_image_new_from_image(t[0], color, 3)) ||
+      vips_bandjoin2(t[1], t[0], &t[2], NULL)) {
+    g_object_unref(base);
+    return 1;
+  }
+
+  res = vips_copy(t[2], out, "interpretation", VIPS_INTERPRETATION_sRGB, NULL);
+  g_object_unref(base);
+
+  return res;
+}
+
+int
+vips_rotate_free_go(VipsImage *in, VipsImage **out, double angle) {
+#if VIPS_SUPPORT_COMPOSITE
+  return vips_similarity(in, out, "angle", angle, NULL);
+#else
+  vips_error("vips_rotate_free_go", "Rotation by arbitrary angle is not supported by used version of libvips");
+  return 1;
+#endif
+}
+
+// Tiles the image over the area of the given size. The spacing is the transparent
+// gap between the tiles, the image should have alpha
+int
+vips_tile_go(VipsImage *in, VipsImage **out, int width, int height, int spacing_x, int spacing_y) {
+  VipsImage *tile, *tmp;
+
+  if (spacing_x > 0 || spacing_y > 0) {
+    if (vips_embed(in, &tile, spacing_x / 2, spacing_y / 2,
+          in->Xsize + spacing_x, in->Ysize + spacing_y, "extend", VIPS_EXTEND_BLACK, NULL))
+      return 1;
+  } else {
+    if (vips_copy(in, &tile, NULL))
+      return 1;
+  }
+
+  int across = (width + tile->Xsize - 1) / tile->Xsize;
+  int down = (height + tile->Ysize - 1) / tile->Ysize;
+
+  int res = vips_replicate(tile, &tmp, across, down, NULL);
+  g_object_unref(tile);
+
+  if (res)
+    return 1;
+
+  res = vips_extract_area(tmp, out, 0, 0, width, height, NULL);
+  g_object_unref(tmp);
+
+  return res;
+}
+
+int
+vips_copy_go(VipsImage *in, VipsImage **out) {
+  return vips_copy(in, out, NULL);
+}
+
+void
+vips_reset_orientation(VipsImage *image) {
+  vips_image_remove(image, EXIF_ORIENTATION);
+  vips_image_set_int(image, "orientation", 1);
+}
+
+int
+vips_is_sensitive_field(const char *name) {
+  return strncmp(name, "exif-ifd3-", 10) == 0 ||
+    strcmp(name, "exif-ifd2-BodySerialNumber") == 0 ||
+    strcmp(name, "exif-ifd2-LensSerialNumber") == 0 ||
+    strcmp(name, "exif-ifd2-MakerNote") == 0 ||
+    strcmp(name, "xmp-data") == 0 ||
+    strcmp(name, "iptc-data") == 0;
+}
+
+void
+vips_remove_sensitive_metadata(VipsImage *image) {
+  gchar **fields = vips_image_get_fields(image);
+
+  for (int i = 0; fields[i] != NULL; i++) {
+    if (vips_is_sensitive_field(fields[i])) {
+      vips_image_remove(image, fields[i]);
+    }
+  }
+
+  g_strfreev(fields);
+}
+
+int
+vips_is_copyright_field(const char *name) {
+  return strcmp(name, "exif-ifd0-Copyright") == 0 ||
+    strcmp(name, "exif-ifd0-Artist") == 0;
+}
+
+int
+vips_is_metadata_field(const char *name) {
+  return strncmp(name, "exif-", 5) == 0 ||
+    strcmp(name, "xmp-data") == 0 ||
+    strcmp(name, "iptc-data") == 0 ||
+    strcmp(name, "icc-profile-data") == 0 ||
+    strcmp(name, "orientation") == 0;
+}
+
+// Removes all the metadata except copyright and artist and the ICC profile
+// if they should be kept. libvips builds the new EXIF from the remaining fields on save
+void
+vips_strip_metadata_go(VipsImage *image, int keep_copyright, int keep_icc) {
+  gchar **fields = vips_image_get_fields(image);
+
+  for (int i = 0; fields[i] != NULL; i++) {
+    if (!vips_is_metadata_field(fields[i]))
+      continue;
+
+    if (keep_copyright && vips_is_copyright_field(fields[i]))
+      continue;
+
+    if (keep_icc && strcmp(fields[i], "icc-profile-data") == 0)
+      continue;
+
+    vips_image_remove(image, fields[i]);
+  }
+
+  g_strfreev(fields);
+}
+
+int
+vips_has_metadata(VipsImage *image) {
+  gchar **fields = vips_image_get_fields(image);
+  int res = 0;
+
+  for (int i = 0; fields[i] != NULL && !res; i++)
+    res = vips_is_metadata_field(fields[i]);
+
+  g_strfreev(fields);
+
+  return res;
+}
+
+int
+vips_has_icc_profile(VipsImage *image) {
+  return vips_image_get_typeof(image, "icc-profile-data") != 0;
+}
+
+int
+vips_get_n_pages(VipsImage *image) {
+  int n_pages;
+
+  if (
+    vips_image_get_typeof(image, "n-pages") != 0 &&
+    !vips_image_get_int(image, "n-pages", &n_pages)
+  ) return n_pages;
+
+  return 1;
+}
+
 int
 vips_support_smartcrop() {
 #if VIPS_SUPPORT_SMARTCROP
@@ -149,8 +489,498 @@ vips_cast_go(VipsImage *in, VipsImage **out, VipsBandFormat format) {
 }
 
 int
-vips_resize_go(VipsImage *in, VipsImage **out, double scale) {
-  return vips_resize(in, out, scale, NULL);
+vips_resize_go(VipsImage *in, VipsImage **out, double hscale, double vscale, VipsKernel kernel) {
+  return vips_resize(in, out, hscale, "vscale", vscale, "kernel", kernel, NULL);
+}
+
+int
+vips_median_go(VipsImage *in, VipsImage **out, int size) {
+  return vips_median(in, out, size, NULL);
+}
+
+int
+vips_gaussblur_go(VipsImage *in, VipsImage **out, double sigma) {
+  return vips_gaussblur(in, out, sigma, NULL);
+}
+
+typedef int (*vips_filter_fn)(VipsImage *, VipsImage **, void *);
+
+// Applies the filter to the colour bands only and joins the alpha back
+static int
+vips_filter_colour_bands(VipsImage *in, VipsImage **out, vips_filter_fn fn, void *data) {
+  VipsImage *colour, *alpha, *filtered;
+
+  if (!vips_image_hasalpha_go(in))
+    return fn(in, out, data);
+
+  if (vips_extract_band(in, &colour, 0, "n", in->Bands - 1, NULL))
+    return 1;
+
+  if (vips_extract_band(in, &alpha, in->Bands - 1, NULL)) {
+    g_object_unref(colour);
+    return 1;
+  }
+
+  int res = fn(colour, &filtered, data);
+  g_object_unref(colour);
+
+  if (res == 0) {
+    res = vips_bandjoin2(filtered, alpha, out, NULL);
+    g_object_unref(filtered);
+  }
+
+  g_object_unref(alpha);
+
+  return res;
+}
+
+static int
+vips_stretch_levels(VipsImage *in, VipsImage **out, void *data) {
+  VipsImage *tmp;
+  int lo, hi;
+  double max = in->BandFmt == VIPS_FORMAT_USHORT ? 65535.0 : 255.0;
+
+  if (vips_percent(in, 1.0, &lo, NULL) || vips_percent(in, 99.0, &hi, NULL))
+    return 1;
+
+  if (hi <= lo)
+    return vips_copy(in, out, NULL);
+
+  double a = max / (hi - lo);
+
+  if (vips_linear1(in, &tmp, a, -lo * a, NULL))
+    return 1;
+
+  int res = vips_cast(tmp, out, in->BandFmt, NULL);
+  g_object_unref(tmp);
+
+  return res;
+}
+
+static int
+vips_hist_equal_global(VipsImage *in, VipsImage **out, void *data) {
+  return vips_hist_equal(in, out, NULL);
+}
+
+static int
+vips_hist_equal_local(VipsImage *in, VipsImage **out, void *data) {
+  int window = VIPS_MAX(8, VIPS_MIN(in->Xsize, in->Ysize) / 8);
+  return vips_hist_local(in, out, window, window, "max_slope", 3, NULL);
+}
+
+int
+vips_autocontrast_go(VipsImage *in, VipsImage **out) {
+  return vips_filter_colour_bands(in, out, vips_stretch_levels, NULL);
+}
+
+typedef struct {
+  double brightness, contrast, gamma;
+} AdjustOptions;
+
+static int
+vips_adjust(VipsImage *in, VipsImage **out, void *data) {
+  AdjustOptions *opts = (AdjustOptions *) data;
+  double max = in->BandFmt == VIPS_FORMAT_USHORT ? 65535.0 : 255.0;
+
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+
+  // Contrast is applied relative to the middle gray, brightness is in 8-bit units
+  double a = opts->contrast;
+  double b = (max / 2.0) * (1.0 - opts->contrast) + opts->brightness * max / 255.0;
+
+  int res =
+    vips_linear1(in, &t[0], a, b, NULL) ||
+    vips_cast(t[0], &t[1], in->BandFmt, NULL);
+
+  if (!res) {
+    if (opts->gamma != 1.0)
+      res =
+        vips_gamma(t[1], &t[2], "exponent", 1.0 / opts->gamma, NULL) ||
+        vips_cast(t[2], out, in->BandFmt, NULL);
+    else
+      res = vips_copy(t[1], out, NULL);
+  }
+
+  g_object_unref(base);
+
+  return res;
+}
+
+int
+vips_adjust_go(VipsImage *in, VipsImage **out, double brightness, double contrast, double gamma) {
+  AdjustOptions opts = {brightness, contrast, gamma};
+  return vips_filter_colour_bands(in, out, vips_adjust, &opts);
+}
+
+typedef struct {
+  double sigma, amount, threshold;
+} UnsharpOptions;
+
+static int
+vips_unsharp(VipsImage *in, VipsImage **out, void *data) {
+  UnsharpOptions *opts = (UnsharpOptions *) data;
+  return vips_sharpen(in, out, "sigma", opts->sigma, "m2", opts->amount, "x1", opts->threshold, NULL);
+}
+
+int
+vips_unsharp_go(VipsImage *in, VipsImage **out, double sigma, double amount, double threshold) {
+  UnsharpOptions opts = {sigma, amount, threshold};
+  return vips_filter_colour_bands(in, out, vips_unsharp, &opts);
+}
+
+// Scales the a and b channels of the LAB colour space that is the same as scaling the chroma
+static int
+vips_saturate(VipsImage *in, VipsImage **out, void *data) {
+  double saturation = *(double *) data;
+
+  if (in->Bands < 3)
+    return vips_copy(in, out, NULL);
+
+  VipsInterpretation interpretation = in->Type;
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 2);
+
+  double a[] = {1.0, saturation, saturation};
+  double b[] = {0.0, 0.0, 0.0};
+
+  int res =
+    vips_colourspace(in, &t[0], VIPS_INTERPRETATION_LAB, NULL) ||
+    vips_linear(t[0], &t[1], a, b, 3, NULL) ||
+    vips_colourspace(t[1], out, interpretation, NULL);
+
+  g_object_unref(base);
+
+  return res;
+}
+
+int
+vips_saturation_go(VipsImage *in, VipsImage **out, double saturation) {
+  return vips_filter_colour_bands(in, out, vips_saturate, &saturation);
+}
+
+int
+vips_equalize_go(VipsImage *in, VipsImage **out, int local) {
+  return vips_filter_colour_bands(in, out, local ? vips_hist_equal_local : vips_hist_equal_global, NULL);
+}
+
+typedef struct {
+  double strength;
+  double r, g, b;
+} VignetteOptions;
+
+static int
+vips_vignette(VipsImage *in, VipsImage **out, void *data) {
+  VignetteOptions *opts = (VignetteOptions *)data;
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 8);
+
+  double scale[2] = {2.0 / in->Xsize, 2.0 / in->Ysize};
+  double offset[2] = {-1.0, -1.0};
+
+  double colour[3] = {opts->r, opts->g, opts->b};
+  double zeros[3] = {0.0, 0.0, 0.0};
+  int bands = in->Bands >= 3 ? 3 : 1;
+
+  if (bands == 1)
+    colour[0] = (opts->r + opts->g + opts->b) / 3.0;
+
+  // Squared distance to the center: 0 in the center, 1 in the corners
+  int res =
+    vips_xyz(&t[0], in->Xsize, in->Ysize, NULL) ||
+    vips_linear(t[0], &t[1], scale, offset, 2, NULL) ||
+    vips_multiply(t[1], t[1], &t[2], NULL) ||
+    vips_bandmean(t[2], &t[3], NULL) ||
+    vips_linear1(t[3], &t[4], -opts->strength, 1.0, NULL) ||
+    vips_multiply(in, t[4], &t[5], NULL) ||
+    vips_linear(t[3], &t[6], colour, zeros, bands, NULL) ||
+    vips_linear1(t[6], &t[7], opts->strength, 0.0, NULL);
+
+  if (!res) {
+    VipsImage *tmp;
+
+    res = vips_add(t[5], t[7], &tmp, NULL);
+    if (!res) {
+      res = vips_cast(tmp, out, in->BandFmt, NULL);
+      g_object_unref(tmp);
+    }
+  }
+
+  g_object_unref(base);
+
+  return res;
+}
+
+int
+vips_vignette_go(VipsImage *in, VipsImage **out, double strength, int r, int g, int b) {
+  VignetteOptions opts = {strength, r, g, b};
+  return vips_filter_colour_bands(in, out, vips_vignette, &opts);
+}
+
+static int
+vips_pad_blurred(VipsImage *in, VipsImage **out, int width, int height, int left, int top) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+
+  // Add a pixel to be sure the resized image covers the canvas
+  double scale = VIPS_MAX((width + 1.0) / in->Xsize, (height + 1.0) / in->Ysize);
+
+  int res =
+    vips_resize(in, &t[0], scale, NULL) ||
+    vips_extract_area(t[0], &t[1], (t[0]->Xsize - width) / 2, (t[0]->Ysize - height) / 2, width, height, NULL) ||
+    vips_gaussblur(t[1], &t[2], VIPS_MAX(width, height) / 32.0, NULL) ||
+    vips_insert(t[2], in, out, left, top, NULL);
+
+  g_object_unref(base);
+
+  return res;
+}
+
+// Creates the opaque background of the given colour matching the image bands
+static VipsArrayDouble *
+vips_background_array(VipsImage *in, int r, int g, int b) {
+  double max = in->BandFmt == VIPS_FORMAT_USHORT ? 65535.0 : 255.0;
+  double k = max / 255.0;
+  double bg[4];
+  int n = 0;
+
+  if (in->Bands >= 3) {
+    bg[n++] = r * k;
+    bg[n++] = g * k;
+    bg[n++] = b * k;
+  } else {
+    bg[n++] = (r + g + b) / 3.0 * k;
+  }
+
+  if (vips_image_hasalpha_go(in))
+    bg[n++] = max;
+
+  return vips_array_double_new(bg, n);
+}
+
+int
+vips_pad_go(VipsImage *in, VipsImage **out, int width, int height, int left, int top, int blur, int r, int g, int b) {
+  if (blur)
+    return vips_pad_blurred(in, out, width, height, left, top);
+
+  VipsArrayDouble *background = vips_background_array(in, r, g, b);
+
+  int res = vips_embed(in, out, left, top, width, height,
+    "extend", VIPS_EXTEND_BACKGROUND, "background", background, NULL);
+
+  vips_area_unref((VipsArea *)background);
+
+  return res;
+}
+
+int
+vips_flatten_go(VipsImage *in, VipsImage **out, int r, int g, int b) {
+  if (!vips_image_hasalpha_go(in))
+    return vips_copy(in, out, NULL);
+
+  double max = in->BandFmt == VIPS_FORMAT_USHORT ? 65535.0 : 255.0;
+  double k = max / 255.0;
+  double bg[3] = {r * k, g * k, b * k};
+  int n = 3;
+
+  if (in->Bands < 4) {
+    bg[0] = (r + g + b) / 3.0 * k;
+    n = 1;
+  }
+
+  VipsArrayDouble *background = vips_array_double_new(bg, n);
+
+  VipsImage *tmp;
+  int res = vips_flatten(in, &tmp, "background", background, "max_alpha", max, NULL);
+
+  vips_area_unref((VipsArea *)background);
+
+  if (res == 0) {
+    res = vips_cast(tmp, out, in->BandFmt, NULL);
+    g_object_unref(tmp);
+  }
+
+  return res;
+}
+
+int
+vips_rotate_fill_go(VipsImage *in, VipsImage **out, double angle, int r, int g, int b) {
+#if VIPS_SUPPORT_COMPOSITE
+  VipsArrayDouble *background = vips_background_array(in, r, g, b);
+
+  int res = vips_similarity(in, out, "angle", angle, "background", background, NULL);
+
+  vips_area_unref((VipsArea *)background);
+
+  return res;
+#else
+  vips_error("vips_rotate_fill_go", "Rotation by arbitrary angle is not supported by used version of libvips");
+  return 1;
+#endif
+}
+
+// Makes the corners of the image transparent using the rounded rectangle mask
+// rendered by librsvg, so the edges are antialiased
+int
+vips_round_corners_go(VipsImage *in, VipsImage **out, int rx, int ry) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 8);
+
+  char *svg = g_strdup_printf(
+    "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\">"
+    "<rect width=\"%d\" height=\"%d\" rx=\"%d\" ry=\"%d\" fill=\"#fff\"/></svg>",
+    in->Xsize, in->Ysize, in->Xsize, in->Ysize, rx, ry);
+
+  if (vips_svgload_buffer(svg, strlen(svg), &t[0], NULL) ||
+      vips_extract_band(t[0], &t[1], 3, NULL) ||
+      !(t[2] = vips_image_copy_memory(t[1]))) {
+    g_free(svg);
+    g_object_unref(base);
+    return 1;
+  }
+
+  // The mask is in memory already, so the SVG isn't needed anymore
+  g_free(svg);
+
+  double max = in->BandFmt == VIPS_FORMAT_USHORT ? 65535.0 : 255.0;
+
+  if (vips_image_hasalpha_go(in)) {
+    if (vips_extract_band(in, &t[3], 0, "n", in->Bands - 1, NULL) ||
+        vips_extract_band(in, &t[4], in->Bands - 1, NULL) ||
+        vips_multiply(t[4], t[2], &t[5], NULL) ||
+        vips_linear1(t[5], &t[6], 1.0 / 255.0, 0, NULL)) {
+      g_object_unref(base);
+      return 1;
+    }
+  } else {
+    if (vips_copy(in, &t[3], NULL) ||
+        vips_linear1(t[2], &t[6], max / 255.0, 0, NULL)) {
+      g_object_unref(base);
+      return 1;
+    }
+  }
+
+  if (vips_cast(t[6], &t[7], in->BandFmt, NULL) ||
+      vips_bandjoin2(t[3], t[7], out, NULL)) {
+    g_object_unref(base);
+    return 1;
+  }
+
+  g_object_unref(base);
+
+  return 0;
+}
+
+int
+vips_find_trim_go(VipsImage *in, double threshold, int auto_color, int r, int g, int b,
+                  int *left, int *top, int *width, int *height) {
+#if VIPS_SUPPORT_FIND_TRIM
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 1);
+
+  VipsImage *tmp = in;
+
+  // Alpha doesn't matter here, so we look only at the colour bands
+  if (vips_image_hasalpha_go(in)) {
+    if (vips_extract_band(in, &t[0], 0, "n", in->Bands - 1, NULL)) {
+      g_object_unref(base);
+      return 1;
+    }
+    tmp = t[0];
+  }
+
+  VipsArrayDouble *background;
+
+  if (auto_color) {
+    double *point;
+    int n;
+
+    if (vips_getpoint(tmp, &point, &n, 0, 0, NULL)) {
+      g_object_unref(base);
+      return 1;
+    }
+
+    background = vips_array_double_new(point, n);
+    g_free(point);
+  } else {
+    background = vips_background_array(tmp, r, g, b);
+  }
+
+  int res = vips_find_trim(tmp, left, top, width, height,
+    "threshold", threshold, "background", background, NULL);
+
+  vips_area_unref((VipsArea *)background);
+  g_object_unref(base);
+
+  return res;
+#else
+  vips_error("vips_find_trim_go", "Trim is not supported by used version of libvips");
+  return 1;
+#endif
+}
+
+// vips_dssim_go calculates the structural dissimilarity (1/SSIM - 1) of 8-bit images of the same size.
+// SSIM is calculated with the 11x11 Gaussian window for each band and averaged. Alpha is ignored
+int
+vips_dssim_go(VipsImage *a, VipsImage *b, double *dssim) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 27);
+
+  int a_bands = vips_image_hasalpha_go(a) ? a->Bands - 1 : a->Bands;
+  int b_bands = vips_image_hasalpha_go(b) ? b->Bands - 1 : b->Bands;
+  int bands = VIPS_MIN(a_bands, b_bands);
+
+  // Stabilizing constants for the 8-bit dynamic range
+  double c1 = (0.01 * 255) * (0.01 * 255);
+  double c2 = (0.03 * 255) * (0.03 * 255);
+
+  double ssim;
+
+  if (
+    vips_extract_band(a, &t[0], 0, "n", bands, NULL) ||
+    vips_extract_band(b, &t[1], 0, "n", bands, NULL) ||
+    vips_cast(t[0], &t[2], VIPS_FORMAT_FLOAT, NULL) ||
+    vips_cast(t[1], &t[3], VIPS_FORMAT_FLOAT, NULL) ||
+    // Means
+    vips_gaussblur(t[2], &t[4], 1.5, "precision", VIPS_PRECISION_FLOAT, NULL) ||
+    vips_gaussblur(t[3], &t[5], 1.5, "precision", VIPS_PRECISION_FLOAT, NULL) ||
+    // Variances and covariance
+    vips_multiply(t[2], t[2], &t[6], NULL) ||
+    vips_multiply(t[3], t[3], &t[7], NULL) ||
+    vips_multiply(t[2], t[3], &t[8], NULL) ||
+    vips_gaussblur(t[6], &t[9], 1.5, "precision", VIPS_PRECISION_FLOAT, NULL) ||
+    vips_gaussblur(t[7], &t[10], 1.5, "precision", VIPS_PRECISION_FLOAT, NULL) ||
+    vips_gaussblur(t[8], &t[11], 1.5, "precision", VIPS_PRECISION_FLOAT, NULL) ||
+    vips_multiply(t[4], t[4], &t[12], NULL) ||
+    vips_multiply(t[5], t[5], &t[13], NULL) ||
+    vips_multiply(t[4], t[5], &t[14], NULL) ||
+    vips_subtract(t[9], t[12], &t[15], NULL) ||
+    vips_subtract(t[10], t[13], &t[16], NULL) ||
+    vips_subtract(t[11], t[14], &t[17], NULL) ||
+    // (2 * mu_a * mu_b + c1) * (2 * sigma_ab + c2)
+    vips_linear1(t[14], &t[18], 2, c1, NULL) ||
+    vips_linear1(t[17], &t[19], 2, c2, NULL) ||
+    vips_multiply(t[18], t[19], &t[20], NULL) ||
+    // (mu_a^2 + mu_b^2 + c1) * (sigma_a^2 + sigma_b^2 + c2)
+    vips_add(t[12], t[13], &t[21], NULL) ||
+    vips_linear1(t[21], &t[22], 1, c1, NULL) ||
+    vips_add(t[15], t[16], &t[23], NULL) ||
+    vips_linear1(t[23], &t[24], 1, c2, NULL) ||
+    vips_multiply(t[22], t[24], &t[25], NULL) ||
+    vips_divide(t[20], t[25], &t[26], NULL) ||
+    vips_avg(t[26], &ssim, NULL)
+  ) {
+    g_object_unref(base);
+    return 1;
+  }
+
+  g_object_unref(base);
+
+  *dssim = ssim > 0 ? 1 / ssim - 1 : 1;
+  if (*dssim < 0)
+    *dssim = 0;
+
+  return 0;
 }
 
 int
@@ -163,6 +993,28 @@ vips_icc_import_go(VipsImage *in, VipsImage **out, char *profile) {
   return vips_icc_import(in, out, "input_profile", profile, "embedded", TRUE, "pcs", VIPS_PCS_XYZ, NULL);
 }
 
+// Wide gamut RGB images look dull when their profile is stripped,
+// so images with embedded RGB profiles are converted to sRGB too
+int
+vips_need_icc_transform(VipsImage *in) {
+#if VIPS_SUPPORT_BUILTIN_ICC
+  return in->Type == VIPS_INTERPRETATION_CMYK || (
+    (in->Type == VIPS_INTERPRETATION_sRGB || in->Type == VIPS_INTERPRETATION_RGB16) &&
+    vips_image_get_typeof(in, "icc-profile-data") != 0
+  );
+#else
+  return 0;
+#endif
+}
+
+int
+vips_icc_transform_go(VipsImage *in, VipsImage **out, char *fallback_profile) {
+  int depth = in->BandFmt == VIPS_FORMAT_USHORT ? 16 : 8;
+
+  return vips_icc_transform(in, out, "srgb",
+    "input_profile", fallback_profile, "embedded", TRUE, "depth", depth, NULL);
+}
+
 int
 vips_colourspace_go(VipsImage *in, VipsImage **out, VipsInterpretation cs) {
   return vips_colourspace(in, out, cs, NULL);
@@ -179,9 +1031,14 @@ vips_flip_horizontal_go(VipsImage *in, VipsImage **out) {
 }
 
 int
-vips_smartcrop_go(VipsImage *in, VipsImage **out, int width, int height) {
+vips_flip_vertical_go(VipsImage *in, VipsImage **out) {
+  return vips_flip(in, out, VIPS_DIRECTION_VERTICAL, NULL);
+}
+
+int
+vips_smartcrop_go(VipsImage *in, VipsImage **out, int width, int height, VipsInteresting interesting) {
 #if VIPS_SUPPORT_SMARTCROP
-  return vips_smartcrop(in, out, width, height, NULL);
+  return vips_smartcrop(in, out, width, height, "interesting", interesting, NULL);
 #else
   return 1;
 #endif
@@ -193,18 +1050,95 @@ vips_extract_area_go(VipsImage *in, VipsImage **out, int left, int top, int widt
 }
 
 int
-vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int strip, int quality, int interlace) {
-  return vips_jpegsave_buffer(in, buf, len, "strip", strip, "Q", quality, "optimize_coding", TRUE, "interlace", interlace, NULL);
+vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int strip, int quality, int interlace, int no_subsample) {
+#if VIPS_SUPPORT_SUBSAMPLE_MODE
+  VipsForeignSubsample subsample = no_subsample ? VIPS_FOREIGN_SUBSAMPLE_OFF : VIPS_FOREIGN_SUBSAMPLE_AUTO;
+
+  return vips_jpegsave_buffer(
+    in, buf, len,
+    "strip", strip,
+    "Q", quality,
+    "optimize_coding", TRUE,
+    "interlace", interlace,
+    "subsample_mode", subsample,
+    NULL
+  );
+#else
+  return vips_jpegsave_buffer(
+    in, buf, len,
+    "strip", strip,
+    "Q", quality,
+    "optimize_coding", TRUE,
+    "interlace", interlace,
+    "no_subsample", no_subsample,
+    NULL
+  );
+#endif
+}
+
+int
+vips_pngsave_go(VipsImage *in, void **buf, size_t *len, int strip, int colors, double dither, int interlace) {
+  if (colors > 0) {
+  #if VIPS_SUPPORT_PNG_QUANTIZATION
+    return vips_pngsave_buffer(
+      in, buf, len,
+      "strip", strip,
+      "filter", VIPS_FOREIGN_PNG_FILTER_NONE,
+      "interlace", interlace,
+      "palette", TRUE,
+      "colours", colors,
+      "dither", dither,
+      NULL
+    );
+  #else
+    vips_error("vips_pngsave_go", "PNG quantization is not supported by used version of libvips");
+    return 1;
+  #endif
+  }
+
+  return vips_pngsave_buffer(in, buf, len, "strip", strip, "filter", VIPS_FOREIGN_PNG_FILTER_NONE, "interlace", interlace, NULL);
+}
+
+int
+vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int strip, int quality, int lossless) {
+  return vips_webpsave_buffer(in, buf, len, "strip", strip, "Q", quality, "lossless", lossless, NULL);
 }
 
 int
-vips_pngsave_go(VipsImage *in, void **buf, size_t *len) {
-  return vips_pngsave_buffer(in, buf, len, "filter", VIPS_FOREIGN_PNG_FILTER_NONE, NULL);
+vips_avifsave_go(VipsImage *in, void **buf, size_t *len, int strip, int quality, int effort) {
+#if VIPS_SUPPORT_AVIF_EFFORT
+  return vips_heifsave_buffer(
+    in, buf, len,
+    "strip", strip,
+    "Q", quality,
+    "compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1,
+    "effort", effort,
+    NULL
+  );
+#elif VIPS_SUPPORT_AVIF
+  // Older versions use speed which is the inverse of effort
+  return vips_heifsave_buffer(
+    in, buf, len,
+    "strip", strip,
+    "Q", quality,
+    "compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1,
+    "speed", VIPS_MIN(9 - effort, 8),
+    NULL
+  );
+#else
+  vips_error("vips_avifsave_go", "AVIF is not supported by used version of libvips");
+  return 1;
+#endif
 }
 
 int
-vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int strip, int quality) {
-  return vips_webpsave_buffer(in, buf, len, "strip", strip, "Q", quality, NULL);
+vips_jxlsave_go(VipsImage *in, void **buf, size_t *len, int strip, int quality, int effort) {
+#if VIPS_SUPPORT_JXL
+  return vips_jxlsave_buffer(in, buf, len, "strip", strip, "Q", quality, "effort", effort, NULL);
+#else
+  vips_error("vips_jxlsave_go", "JPEG XL is not supported by used version of libvips");
+  return 1;
+#endif
 }
 
 void
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type watermarkOptions struct {
+	Name string
+	// URL of the watermark image that is downloaded instead of using the named one
+	URL     string
+	Opacity float64
+	Gravity gravityType
+	Tile    bool
+	Scale   float64
+	Rotate  float64
+	// XOffset and YOffset move the watermark away from the edges it's attached to
+	XOffset int
+	YOffset int
+	Blend   blendMode
+}
+
+func newWatermarkOptions() watermarkOptions {
+	return watermarkOptions{
+		Opacity: 1,
+		Gravity: SOUTH_EAST,
+		Blend:   BLEND_OVER,
+	}
+}
+
+type watermark struct {
+	Data     []byte
+	Type     imageType
+	Defaults watermarkOptions
+}
+
+type watermarkConfig struct {
+	Path    string  `yaml:"path"`
+	Data    string  `yaml:"data"`
+	Opacity float64 `yaml:"opacity"`
+	Gravity string  `yaml:"gravity"`
+	Scale   float64 `yaml:"scale"`
+	Rotate  float64 `yaml:"rotate"`
+	XOffset int     `yaml:"x_offset"`
+	YOffset int     `yaml:"y_offset"`
+}
+
+// defaultWatermarkName is the name of the watermark defined by the environment variables
+const defaultWatermarkName = "default"
+
+var watermarks = make(map[string]*watermark)
+
+// parseWatermarkPosition parses the watermark gravity. "re" means that the watermark
+// is repeated over the whole image
+func parseWatermarkPosition(str string) (gravityType, bool, error) {
+	if str == "re" {
+		return CENTER, true, nil
+	}
+
+	if g, ok := gravityTypes[str]; ok && g != SMART {
+		return g, false, nil
+	}
+
+	return CENTER, false, fmt.Errorf("Invalid watermark position: %s", str)
+}
+
+func loadWatermarkData(name string, wc watermarkConfig) ([]byte, error) {
+	if len(wc.Data) > 0 {
+		data, err := base64.StdEncoding.DecodeString(wc.Data)
+		if err != nil {
+			return nil, fmt.Errorf("Can't decode watermark %s data: %s", name, err)
+		}
+		return data, nil
+	}
+
+	data, err := ioutil.ReadFile(wc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read watermark %s: %s", name, err)
+	}
+
+	return data, nil
+}
+
+func loadWatermark(name string, wc watermarkConfig) (*watermark, error) {
+	data, err := loadWatermarkData(name, wc)
+	if err != nil {
+		return nil, err
+	}
+
+	_, imgtypeStr, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Can't decode watermark %s: %s", name, err)
+	}
+
+	imgtype, ok := imageTypes[imgtypeStr]
+	if !ok || !vipsTypeSupportLoad[imgtype] {
+		return nil, fmt.Errorf("Watermark %s image type is not supported", name)
+	}
+
+	wm := watermark{
+		Data:     data,
+		Type:     imgtype,
+		Defaults: newWatermarkOptions(),
+	}
+
+	wm.Defaults.Name = name
+	wm.Defaults.Scale = wc.Scale
+	wm.Defaults.Rotate = wc.Rotate
+	wm.Defaults.XOffset = wc.XOffset
+	wm.Defaults.YOffset = wc.YOffset
+
+	if wc.Opacity < 0 || wc.Opacity > 1 {
+		return nil, fmt.Errorf("Watermark %s opacity should be between 0 and 1", name)
+	} else if wc.Opacity > 0 {
+		wm.Defaults.Opacity = wc.Opacity
+	}
+
+	if len(wc.Gravity) > 0 {
+		if wm.Defaults.Gravity, wm.Defaults.Tile, err = parseWatermarkPosition(wc.Gravity); err != nil {
+			return nil, fmt.Errorf("Watermark %s gravity is invalid: %s", name, wc.Gravity)
+		}
+	}
+
+	if wc.Scale < 0 || wc.Scale > 1 {
+		return nil, fmt.Errorf("Watermark %s scale should be between 0 and 1", name)
+	}
+
+	return &wm, nil
+}
+
+// initWatermarks loads the named watermarks described in the YAML file
+// and the default one defined by the environment variables
+func initWatermarks() {
+	if len(conf.WatermarkPath) > 0 || len(conf.WatermarkData) > 0 {
+		wm, err := loadWatermark(defaultWatermarkName, watermarkConfig{
+			Path:    conf.WatermarkPath,
+			Data:    conf.WatermarkData,
+			Opacity: conf.WatermarkOpacity,
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+		watermarks[defaultWatermarkName] = wm
+	}
+
+	if len(conf.WatermarksPath) == 0 {
+		return
+	}
+
+	src, err := ioutil.ReadFile(conf.WatermarksPath)
+	if err != nil {
+		log.Fatalf("Can't read watermarks file: %s\n", err)
+	}
+
+	var wcs map[string]watermarkConfig
+
+	if err = yaml.Unmarshal(src, &wcs); err != nil {
+		log.Fatalf("Can't parse watermarks file: %s\n", err)
+	}
+
+	for name, wc := range wcs {
+		wm, err := loadWatermark(name, wc)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		watermarks[name] = wm
+	}
+}
+
+type cachedWatermark struct {
+	wm      *watermark
+	expires time.Time
+}
+
+var (
+	urlWatermarks   = make(map[string]cachedWatermark)
+	urlWatermarksMu sync.Mutex
+)
+
+// getURLWatermark downloads the watermark image by its URL. Downloaded watermarks
+// are cached in memory since the same watermark is usually used by lots of requests
+func getURLWatermark(url string, po processingOptions) (*watermark, error) {
+	now := time.Now()
+
+	urlWatermarksMu.Lock()
+	cached, ok := urlWatermarks[url]
+	urlWatermarksMu.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		return cached.wm, nil
+	}
+
+	data, imgtype, _, err := downloadImage(url, po, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Can't download watermark: %s", err)
+	}
+
+	if imgtype == VIDEO {
+		return nil, errors.New("Watermark image type is not supported")
+	}
+
+	wm := &watermark{Data: data, Type: imgtype}
+
+	if conf.WatermarkCacheSize <= 0 {
+		return wm, nil
+	}
+
+	urlWatermarksMu.Lock()
+	defer urlWatermarksMu.Unlock()
+
+	if len(urlWatermarks) >= conf.WatermarkCacheSize {
+		for u, c := range urlWatermarks {
+			if now.After(c.expires) {
+				delete(urlWatermarks, u)
+			}
+		}
+	}
+
+	// If nothing is expired, drop an arbitrary watermark to make room for the new one
+	if len(urlWatermarks) >= conf.WatermarkCacheSize {
+		for u := range urlWatermarks {
+			delete(urlWatermarks, u)
+			break
+		}
+	}
+
+	urlWatermarks[url] = cachedWatermark{
+		wm:      wm,
+		expires: now.Add(time.Duration(conf.WatermarkCacheTTL) * time.Second),
+	}
+
+	return wm, nil
+}
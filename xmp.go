@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+const rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+// parseXMP returns the XMP properties as "prefix:name" => value.
+// Values of arrays are joined with ", "
+func parseXMP(data []byte) map[string]string {
+	fields := make(map[string]string)
+	prefixes := make(map[string]string)
+
+	name := func(n xml.Name) string {
+		if prefix, ok := prefixes[n.Space]; ok {
+			return prefix + ":" + n.Local
+		}
+		return n.Local
+	}
+
+	set := func(key, value string) {
+		if len(fields[key]) > 0 {
+			fields[key] += ", " + value
+		} else {
+			fields[key] = value
+		}
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+
+	// Property is an element that is a direct child of rdf:Description
+	var stack []xml.Name
+	property := ""
+
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			break
+		}
+
+		switch tok := token.(type) {
+		case xml.StartElement:
+			for _, attr := range tok.Attr {
+				if attr.Name.Space == "xmlns" {
+					prefixes[attr.Value] = attr.Name.Local
+				}
+			}
+
+			if len(stack) > 0 && stack[len(stack)-1].Space == rdfNamespace && stack[len(stack)-1].Local == "Description" {
+				property = name(tok.Name)
+			}
+
+			if tok.Name.Space == rdfNamespace && tok.Name.Local == "Description" {
+				for _, attr := range tok.Attr {
+					if attr.Name.Space != "xmlns" && attr.Name.Space != rdfNamespace && len(attr.Name.Space) > 0 {
+						set(name(attr.Name), attr.Value)
+					}
+				}
+			}
+
+			stack = append(stack, tok.Name)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) > 0 && stack[len(stack)-1].Space == rdfNamespace && stack[len(stack)-1].Local == "Description" {
+				property = ""
+			}
+		case xml.CharData:
+			if value := strings.TrimSpace(string(tok)); len(property) > 0 && len(value) > 0 {
+				set(property, value)
+			}
+		}
+	}
+
+	return fields
+}